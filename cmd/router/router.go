@@ -4,18 +4,26 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/Max-Sum/quipu/router"
 	"github.com/akamensky/argparse"
 )
 
+var modes = []router.ListenMode{router.ModePlain, router.ModeTLS, router.ModeMux, router.ModeTunnel, router.ModeWebSocket}
+
 func main() {
 	parser := argparse.NewParser("quipu-router", "Routes connections based on sni")
 	// Create string flag
-	cfgpath := parser.String("c", "config", &argparse.Options{Help: "Path to config file"})
+	cfgpath := parser.String("c", "config", &argparse.Options{Help: "Path to config file, reloaded on SIGHUP or change"})
 	// Parse input
 	err := parser.Parse(os.Args)
 	if err != nil {
@@ -39,46 +47,318 @@ func main() {
 		}
 	}
 
-	if cfg.ListenPlain == "" && cfg.ListenTLS == "" {
+	router.SetupLogging(cfg)
+	if err := router.SetupAudit(cfg); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// Sockets passed by systemd, named after the listener they replace
+	activated, err := router.ActivatedListeners()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	for name, lns := range activated {
+		if err := checkActivated(name, len(lns)); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	activatedListener := func(name string) net.Listener {
+		if lns := activated[name]; len(lns) > 0 {
+			return lns[0]
+		}
+		return nil
+	}
+	// listenAddrs are the addresses of a mode, none if systemd passed its
+	// sockets instead
+	listenAddrs := func(cfg *router.Config, mode router.ListenMode) []string {
+		if len(activated[mode.String()]) > 0 {
+			return nil
+		}
+		return cfg.ListenAddrs(mode)
+	}
+
+	listening := len(activated) > 0
+	for _, mode := range modes {
+		listening = listening || len(listenAddrs(cfg, mode)) > 0
+	}
+	if !listening {
 		fmt.Print(errors.New("listen address is missing"))
 		os.Exit(1)
 	}
 
-	var plainServer *router.TCPServer
-	var tlsServer *router.TCPServer
-	errCh := make(chan error)
-	if cfg.ListenPlain != "" {
+	servers := make(map[serverKey]*router.TCPServer)
+	var serversMu sync.Mutex // the admin API reads servers
+	errCh := make(chan error, 1)
+	fatal := func(err error) {
+		select {
+		case errCh <- err:
+		default:
+		}
+	}
+	// startServer serves ln, or listens on its own address if ln is nil
+	startServer := func(key serverKey, s *router.TCPServer, ln net.Listener, failed func(error)) {
+		servers[key] = s
 		go func() {
-			plainServer = router.NewTCPServer(cfg.ListenPlain, false, cfg)
-			err = plainServer.ListenAndServe()
+			var err error
+			if ln != nil {
+				err = s.Serve(ln)
+			} else {
+				err = s.ListenAndServe()
+			}
 			if err != nil {
-				errCh <- err
+				failed(err)
 			}
 		}()
 	}
-	if cfg.ListenTLS != "" {
-		go func() {
-			tlsServer = router.NewTCPServer(cfg.ListenTLS, true, cfg)
-			err = tlsServer.ListenAndServe()
+	for _, mode := range modes {
+		for i, ln := range activated[mode.String()] {
+			key := serverKey{mode: mode, addr: fmt.Sprint(i), activated: true}
+			startServer(key, router.NewTCPServer("", mode, cfg), ln, fatal)
+		}
+		for _, addr := range listenAddrs(cfg, mode) {
+			startServer(serverKey{mode: mode, addr: addr}, router.NewTCPServer(addr, mode, cfg), nil, fatal)
+		}
+	}
+
+	metrics := &httpService{name: "metrics", newServer: router.NewMetricsServer, activated: activatedListener("metrics")}
+	metrics.update(cfg.ListenMetrics)
+	admin := &httpService{name: "admin", activated: activatedListener("admin"), newServer: func() *http.Server {
+		return router.NewAdminServer(func() []*router.TCPServer {
+			serversMu.Lock()
+			defer serversMu.Unlock()
+			keys := make([]serverKey, 0, len(servers))
+			for key := range servers {
+				keys = append(keys, key)
+			}
+			sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+			list := make([]*router.TCPServer, len(keys))
+			for i, key := range keys {
+				list[i] = servers[key]
+			}
+			return list
+		})
+	}}
+	admin.update(cfg.ListenAdmin)
+
+	// reload validates the new config before anything is swapped. Existing
+	// connections keep their config, listeners move only if their address
+	// changed. New addresses are bound first: a mode whose new address
+	// fails keeps its old listeners. An address moving to another mode is
+	// freed by its old listener before being bound again.
+	reload := func(reason string) {
+		newCfg, err := router.LoadAllConfsFromEnv()
+		if len(*cfgpath) > 0 {
+			newCfg, err = router.LoadAllConfsFromIni(*cfgpath)
+		}
+		if err != nil {
+			slog.Error("keeping the current config", "reload", reason, "err", err)
+			return
+		}
+		router.SetupLogging(newCfg)
+		if err := router.SetupAudit(newCfg); err != nil {
+			slog.Error("keeping the current audit log", "reload", reason, "err", err)
+		}
+		serversMu.Lock()
+		wanted := make(map[serverKey]bool)
+		for _, mode := range modes {
+			for _, addr := range listenAddrs(newCfg, mode) {
+				wanted[serverKey{mode: mode, addr: addr}] = true
+			}
+		}
+		lns := make(map[serverKey]net.Listener)
+		failed := make(map[router.ListenMode]bool)
+		stopped := make(map[serverKey]bool)
+		for key := range wanted {
+			if servers[key] != nil {
+				continue
+			}
+			for old, s := range servers {
+				if !old.activated && !wanted[old] && old.addr == key.addr {
+					s.StopListening()
+					stopped[old] = true
+				}
+			}
+			ln, err := router.Listen(key.addr)
 			if err != nil {
-				errCh <- err
+				slog.Error("failed to listen, keeping the old listeners", "listener", key.mode.String(), "addr", key.addr, "err", err)
+				failed[key.mode] = true
+				continue
 			}
-		}()
+			lns[key] = ln
+		}
+		for key, s := range servers {
+			// Activated sockets stay whatever the addresses
+			if key.activated || wanted[key] || failed[key.mode] && !stopped[key] {
+				s.SetConf(newCfg)
+				continue
+			}
+			delete(servers, key)
+			go s.Shutdown(newCfg.ShutdownGrace)
+		}
+		for key, ln := range lns {
+			s := router.NewTCPServer(key.addr, key.mode, newCfg)
+			startServer(key, s, ln, func(err error) {
+				slog.Error("listener failed", "listener", key.mode.String(), "addr", key.addr, "err", err)
+				serversMu.Lock()
+				if servers[key] == s {
+					delete(servers, key)
+				}
+				serversMu.Unlock()
+			})
+		}
+		serversMu.Unlock()
+		metrics.update(newCfg.ListenMetrics)
+		admin.update(newCfg.ListenAdmin)
+		cfg = newCfg
+		slog.Info("config reloaded", "reload", reason)
 	}
 
+	changed := make(chan struct{}, 1)
+	if len(*cfgpath) > 0 {
+		go watchFile(*cfgpath, changed)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	select {
-	case <-errCh:
-		fmt.Print(err)
-		os.Exit(1)
-	case <-c:
+wait:
+	for {
+		select {
+		case err := <-errCh:
+			fmt.Print(err)
+			os.Exit(1)
+		case <-hup:
+			reload("SIGHUP")
+		case <-changed:
+			reload("file change")
+		case <-c:
+			break wait
+		}
+	}
+	// graceful exit, draining all listeners at once
+	slog.Info("draining connections", "grace", cfg.ShutdownGrace)
+	var wg sync.WaitGroup
+	cut := 0
+	var mu sync.Mutex
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *router.TCPServer) {
+			defer wg.Done()
+			n := s.Shutdown(cfg.ShutdownGrace)
+			mu.Lock()
+			cut += n
+			mu.Unlock()
+		}(s)
+	}
+	wg.Wait()
+	metrics.close()
+	admin.close()
+	slog.Info("shut down", "cut", cut)
+}
+
+// checkActivated refuses sockets that no listener would serve
+func checkActivated(name string, n int) error {
+	switch name {
+	case "metrics", "admin":
+		if n > 1 {
+			return fmt.Errorf("%d sockets named %s, the %s listener takes one", n, name, name)
+		}
+		return nil
 	}
-	// graceful exit
-	if plainServer != nil {
-		plainServer.Shutdown()
+	for _, mode := range modes {
+		if name == mode.String() {
+			return nil
+		}
+	}
+	return fmt.Errorf("socket named %s matches no listener", name)
+}
+
+// serverKey identifies the server of a listen address, or of the i-th
+// activated socket of a mode
+type serverKey struct {
+	mode      router.ListenMode
+	addr      string
+	activated bool
+}
+
+func (k serverKey) less(o serverKey) bool {
+	if k.mode != o.mode {
+		return k.mode < o.mode
+	}
+	if k.activated != o.activated {
+		return k.activated
 	}
-	if tlsServer != nil {
-		tlsServer.Shutdown()
+	return k.addr < o.addr
+}
+
+// httpService is an optional HTTP listener, moved when its address changes
+// unless it was activated by systemd
+type httpService struct {
+	name      string
+	newServer func() *http.Server
+	activated net.Listener
+	addr      string
+	srv       *http.Server
+}
+
+func (h *httpService) update(addr string) {
+	if h.activated != nil {
+		if h.srv == nil {
+			h.serve(h.activated)
+		}
+		return
+	}
+	if addr == h.addr {
+		return
+	}
+	h.close()
+	h.addr = addr
+	if addr == "" {
+		return
+	}
+	ln, err := router.Listen(addr)
+	if err != nil {
+		slog.Error("failed to listen", "listener", h.name, "addr", addr, "err", err)
+		h.addr = ""
+		return
+	}
+	h.serve(ln)
+}
+
+func (h *httpService) close() {
+	if h.srv != nil {
+		h.srv.Close()
+		h.srv = nil
+	}
+	h.addr = ""
+}
+
+func (h *httpService) serve(ln net.Listener) {
+	addr := ln.Addr().String()
+	h.srv = h.newServer()
+	slog.Info("listening", "listener", h.name, "addr", addr)
+	go func(srv *http.Server) {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Error("failed to serve", "listener", h.name, "addr", addr, "err", err)
+		}
+	}(h.srv)
+}
+
+// watchFile signals changed when the modification time or size of path
+// changes
+func watchFile(path string, changed chan<- struct{}) {
+	last, _ := os.Stat(path)
+	for range time.Tick(2 * time.Second) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if last != nil && (!fi.ModTime().Equal(last.ModTime()) || fi.Size() != last.Size()) {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+		last = fi
 	}
 }
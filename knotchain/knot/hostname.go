@@ -42,6 +42,11 @@ func (d *Domain) Port() uint16 {
 	return d.IPort
 }
 
+// IPs returns the addresses resolved when decoding, if any
+func (d *Domain) IPs() []net.IPAddr {
+	return d.ips
+}
+
 func (d *Domain) Encode() []byte {
 	out := make([]byte, len([]byte(d.Addr))+3)
 	if len([]byte(d.Addr)) > 255 {
@@ -218,6 +218,15 @@ func UntieHostname(hostname string) (Knot, string, error) {
 	return nextKnot, newHost, err
 }
 
+// StemHostname returns the stem of a hostname carrying a knot chain.
+func StemHostname(hostname string) (string, bool) {
+	first, stem, _ := strings.Cut(hostname, ".")
+	if !strings.HasPrefix(first, "q--") {
+		return hostname, false
+	}
+	return stem, true
+}
+
 func KnotString(k Knot) string {
 	return net.JoinHostPort(k.Host(), strconv.FormatUint(uint64(k.Port()), 10))
 }
@@ -0,0 +1,248 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Max-Sum/quipu/knotchain"
+	"github.com/Max-Sum/quipu/knotchain/knot"
+)
+
+// aclRule allows or denies redirect destinations. The rule format is
+//
+//	<allow|deny> <target> [ports]
+//
+// target is *, an IP, a CIDR or a domain, which also matches its
+// subdomains. ports is a comma separated list of ports and ranges, e.g.
+// 80,443,10000-20000. The rules are evaluated once per destination, with
+// its name and resolved IPs: a domain rule matches the name, a deny IP rule
+// matches if any of the IPs is in it and an allow IP rule if all of them
+// are. The first matching rule decides, after all rules the destination is
+// allowed. Loopback and link-local destinations are denied after that,
+// unless let in by an allow IP rule within their range, like
+// allow 127.0.0.1.
+type aclRule struct {
+	allow  bool
+	any    bool
+	ipnet  *net.IPNet
+	domain string
+	ports  [][2]uint16
+}
+
+// Checked after the configured rules
+var defaultACL = []*aclRule{
+	mustParseACLRule("deny 0.0.0.0/8"),
+	mustParseACLRule("deny 127.0.0.0/8"),
+	mustParseACLRule("deny 169.254.0.0/16"),
+	mustParseACLRule("deny ::/128"),
+	mustParseACLRule("deny ::1/128"),
+	mustParseACLRule("deny fe80::/10"),
+	mustParseACLRule("deny localhost"),
+}
+
+func mustParseACLRule(rule string) *aclRule {
+	r, err := parseACLRule(rule)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func parseACLRule(rule string) (*aclRule, error) {
+	fields := strings.Fields(rule)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("invalid acl rule: %s", rule)
+	}
+	r := &aclRule{}
+	switch strings.ToLower(fields[0]) {
+	case "allow":
+		r.allow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("invalid acl action: %s", fields[0])
+	}
+	target := strings.ToLower(fields[1])
+	if target == "*" {
+		r.any = true
+	} else if _, ipnet, err := net.ParseCIDR(target); err == nil {
+		r.ipnet = ipnet
+	} else if ip := net.ParseIP(target); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		r.ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+	} else {
+		r.domain = strings.Trim(target, ".")
+	}
+	if r.ipnet != nil {
+		if ip4 := r.ipnet.IP.To4(); ip4 != nil && len(r.ipnet.Mask) == net.IPv4len {
+			r.ipnet.IP = ip4
+		}
+	}
+	if len(fields) == 3 {
+		for _, portr := range strings.Split(fields[2], ",") {
+			floor, ceil, ok := strings.Cut(portr, "-")
+			if !ok {
+				ceil = floor
+			}
+			flooru, err := strconv.ParseUint(strings.TrimSpace(floor), 10, 16)
+			if err != nil {
+				return nil, err
+			}
+			ceilu, err := strconv.ParseUint(strings.TrimSpace(ceil), 10, 16)
+			if err != nil {
+				return nil, err
+			}
+			if flooru > ceilu {
+				return nil, fmt.Errorf("invalid port range: %s", portr)
+			}
+			r.ports = append(r.ports, [2]uint16{uint16(flooru), uint16(ceilu)})
+		}
+	}
+	return r, nil
+}
+
+func (r *aclRule) matchPort(port uint16) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, pr := range r.ports {
+		if port >= pr[0] && port <= pr[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// match checks a destination by its domain name, empty for an IP, and its
+// IPs. An IP rule matches if any of the IPs is in it, or all of them with
+// every set.
+func (r *aclRule) match(domain string, ips []net.IP, port uint16, every bool) bool {
+	if !r.matchPort(port) {
+		return false
+	}
+	switch {
+	case r.any:
+		return true
+	case r.ipnet != nil:
+		if len(ips) == 0 {
+			return false
+		}
+		for _, ip := range ips {
+			if r.ipnet.Contains(ip) != every {
+				return !every
+			}
+		}
+		return every
+	case r.domain != "":
+		return domain != "" && (domain == r.domain || strings.HasSuffix(domain, "."+r.domain))
+	}
+	return false
+}
+
+// within tells whether the network of r lies inside that of outer
+func (r *aclRule) within(outer *aclRule) bool {
+	if r == nil || r.ipnet == nil || outer.ipnet == nil {
+		return false
+	}
+	ones, bits := r.ipnet.Mask.Size()
+	outerOnes, outerBits := outer.ipnet.Mask.Size()
+	return bits == outerBits && outerOnes <= ones && outer.ipnet.Contains(r.ipnet.IP)
+}
+
+// destDomain is the name rules match host by, empty for an IP
+func destDomain(host string) string {
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// IsDestAllowed tells whether a redirect may go to host, which resolved
+// to ips, on port
+func (c *Config) IsDestAllowed(host string, ips []net.IP, port uint16) bool {
+	domain := destDomain(host)
+	var allowed *aclRule
+	for _, r := range c.acl {
+		if r.match(domain, ips, port, r.allow) {
+			if !r.allow {
+				return false
+			}
+			allowed = r
+			break
+		}
+	}
+	for _, r := range defaultACL {
+		if r.match(domain, ips, port, false) && !allowed.within(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Config) BuildACL() error {
+	c.acl = nil
+	return c.addACLRules(strings.Split(c.ACLRules, ";"))
+}
+
+func (c *Config) addACLRules(rules []string) error {
+	for _, rule := range rules {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		r, err := parseACLRule(rule)
+		if err != nil {
+			return err
+		}
+		c.acl = append(c.acl, r)
+	}
+	return nil
+}
+
+// knotIPs returns the IPs a knot carries, nil for a name to resolve
+func knotIPs(k knotchain.Knot) []net.IP {
+	var d *knot.Domain
+	switch k := k.(type) {
+	case *knot.IP:
+		return []net.IP{k.Addr}
+	case *knot.Domain:
+		d = k
+	case *knot.Refer:
+		d = &k.Domain
+	}
+	if d == nil || d.IPs() == nil {
+		return nil
+	}
+	ips := make([]net.IP, len(d.IPs()))
+	for i, ip := range d.IPs() {
+		ips[i] = ip.IP
+	}
+	return ips
+}
+
+// resolveKnot returns the IPs a knot will be dialed at
+func resolveKnot(ctx context.Context, k knotchain.Knot) ([]net.IP, error) {
+	if ips := knotIPs(k); ips != nil {
+		return ips, nil
+	}
+	return net.DefaultResolver.LookupIP(ctx, "ip", k.Host())
+}
+
+// dialIPs dials the resolved addresses of a knot in turn, through an
+// upstream proxy if not nil
+func dialIPs(ctx context.Context, upstream *url.URL, ips []net.IP, port uint16) (net.Conn, error) {
+	portStr := strconv.FormatUint(uint64(port), 10)
+	err := fmt.Errorf("no address to dial")
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialUpstream(ctx, upstream, net.JoinHostPort(ip.String(), portStr))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,55 @@
+package router
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsDestAllowed(t *testing.T) {
+	exampleIPs := []net.IP{net.ParseIP("93.184.216.34"), net.ParseIP("2606:2800:220:1:248:1893:25c7:1946")}
+	tests := []struct {
+		name  string
+		rules string
+		host  string
+		ips   []net.IP
+		port  uint16
+		want  bool
+	}{
+		{"no rules", "", "example.com", exampleIPs, 443, true},
+		{"allow domain then deny all", "allow example.com; deny *", "example.com", exampleIPs, 443, true},
+		{"allow domain covers subdomains", "allow example.com; deny *", "www.example.com", exampleIPs, 443, true},
+		{"allow domain, other domain", "allow example.com; deny *", "example.org", exampleIPs, 443, false},
+		{"allow cidr then deny all, domain knot", "allow 93.184.216.0/24; deny *", "example.org", exampleIPs[:1], 443, true},
+		{"allow cidr then deny all, ip knot", "allow 93.184.216.0/24; deny *", "93.184.216.34", exampleIPs[:1], 443, true},
+		{"allow cidr needs every ip", "allow 93.184.216.0/24; deny *", "example.com", exampleIPs, 443, false},
+		{"allow cidr, unresolved", "allow 93.184.216.0/24; deny *", "example.com", nil, 443, false},
+		{"deny cidr matches any ip", "deny 2606:2800::/32", "example.com", exampleIPs, 443, false},
+		{"deny domain", "deny example.com", "www.example.com", exampleIPs, 443, false},
+		{"port outside rule", "allow example.com 80; deny *", "example.com", exampleIPs, 443, false},
+		{"port inside rule", "allow example.com 80,400-500; deny *", "example.com", exampleIPs, 443, true},
+		{"first match decides", "deny example.com; allow *", "example.com", exampleIPs, 443, false},
+		{"default denies loopback", "", "127.0.0.1", []net.IP{net.ParseIP("127.0.0.1")}, 80, false},
+		{"default denies link-local", "", "metadata.internal", []net.IP{net.ParseIP("169.254.169.254")}, 80, false},
+		{"default denies localhost", "", "localhost", nil, 80, false},
+		{"domain allow keeps default denies", "allow evil.example", "evil.example", []net.IP{net.ParseIP("127.0.0.1")}, 80, false},
+		{"allow all keeps default denies", "allow *", "127.0.0.1", []net.IP{net.ParseIP("127.0.0.1")}, 80, false},
+		{"ip allow lifts default denies", "allow 127.0.0.1", "127.0.0.1", []net.IP{net.ParseIP("127.0.0.1")}, 80, true},
+		{"allow all v4 keeps default denies", "allow 0.0.0.0/0", "127.0.0.1", []net.IP{net.ParseIP("127.0.0.1")}, 80, false},
+		{"allow all v4 keeps metadata denied", "allow 0.0.0.0/0 443; deny *", "169.254.169.254", []net.IP{net.ParseIP("169.254.169.254")}, 443, false},
+		{"allow all v4 still allows public", "allow 0.0.0.0/0 443; deny *", "example.com", exampleIPs[:1], 443, true},
+		{"allow all v6 keeps loopback denied", "allow ::/0", "::1", []net.IP{net.ParseIP("::1")}, 80, false},
+		{"allow inside loopback range", "allow 127.0.0.0/24", "127.0.0.5", []net.IP{net.ParseIP("127.0.0.5")}, 80, true},
+		{"allow wider than loopback range", "allow 126.0.0.0/7", "127.0.0.5", []net.IP{net.ParseIP("127.0.0.5")}, 80, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{ACLRules: tt.rules}
+			if err := c.BuildACL(); err != nil {
+				t.Fatal(err)
+			}
+			if got := c.IsDestAllowed(tt.host, tt.ips, tt.port); got != tt.want {
+				t.Errorf("IsDestAllowed(%q, %v, %d) = %v, want %v", tt.host, tt.ips, tt.port, got, tt.want)
+			}
+		})
+	}
+}
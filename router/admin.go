@@ -0,0 +1,236 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// connInfo tracks a connection for the admin API
+type connInfo struct {
+	id       uint64
+	start    time.Time
+	up, down *relayCounter
+
+	mu       sync.Mutex
+	client   string
+	proto    string
+	origHost string
+	hostname string
+	knot     string
+	backend  string
+	reason   string
+	err      error
+}
+
+// closing records why the connection ends, unless already known: eof,
+// idle_timeout, relay_error, rejected, handshake_failed, dial_failed,
+// killed or shutdown
+func (c *connInfo) closing(reason string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reason == "" {
+		c.reason, c.err = reason, err
+	}
+}
+
+func (c *connInfo) closeReason() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reason, c.err
+}
+
+// ConnStatus is a connection as listed by the admin API
+type ConnStatus struct {
+	ID        uint64    `json:"id"`
+	Listener  string    `json:"listener"`
+	Client    string    `json:"client"`
+	Proto     string    `json:"proto,omitempty"`
+	OrigHost  string    `json:"orig_host,omitempty"`
+	Hostname  string    `json:"hostname,omitempty"`
+	Knot      string    `json:"knot,omitempty"`
+	Backend   string    `json:"backend,omitempty"`
+	Start     time.Time `json:"start"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+}
+
+// ListenerStatus is a listener as listed by the admin API
+type ListenerStatus struct {
+	Listener  string `json:"listener"`
+	Addr      string `json:"addr"`
+	Listening bool   `json:"listening"`
+	Active    int    `json:"active"`
+	Rejected  uint64 `json:"rejected"`
+}
+
+func (c *connInfo) status(listener string) ConnStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ConnStatus{
+		ID:        c.id,
+		Listener:  listener,
+		Client:    c.client,
+		Proto:     c.proto,
+		OrigHost:  c.origHost,
+		Hostname:  c.hostname,
+		Knot:      c.knot,
+		Backend:   c.backend,
+		Start:     c.start,
+		BytesUp:   c.up.n.Load(),
+		BytesDown: c.down.n.Load(),
+	}
+}
+
+// Conns lists the connections being handled
+func (s *TCPServer) Conns() []ConnStatus {
+	s.mu.Lock()
+	infos := make([]*connInfo, 0, len(s.conns))
+	for _, info := range s.conns {
+		infos = append(infos, info)
+	}
+	s.mu.Unlock()
+	conns := make([]ConnStatus, len(infos))
+	for i, info := range infos {
+		conns[i] = info.status(s.mode.String())
+	}
+	return conns
+}
+
+// CloseConn closes the connection of id, telling whether it was found
+func (s *TCPServer) CloseConn(id uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, info := range s.conns {
+		if info.id == id {
+			info.closing("killed", nil)
+			conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+func (s *TCPServer) Status() ListenerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return ListenerStatus{
+		Listener:  s.mode.String(),
+		Addr:      s.listen,
+		Listening: s.ln != nil && !s.closed,
+		Active:    len(s.conns),
+		Rejected:  s.rejected.Load(),
+	}
+}
+
+// NewAdminServer returns a server for the admin API over the listeners
+// returned by servers:
+//
+//	GET    /listeners              status of the listeners
+//	GET    /connections            connections, filtered by ?listener= and ?client=
+//	DELETE /connections/{id}       close a connection
+//	DELETE /connections?client=    close the connections of a client IP
+func NewAdminServer(servers func() []*TCPServer) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /listeners", func(w http.ResponseWriter, r *http.Request) {
+		status := []ListenerStatus{}
+		for _, s := range servers() {
+			status = append(status, s.Status())
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+	mux.HandleFunc("GET /connections", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, filterConns(servers(), r))
+	})
+	mux.HandleFunc("DELETE /connections/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		for _, s := range servers() {
+			if s.CloseConn(id) {
+				writeJSON(w, http.StatusOK, map[string]int{"closed": 1})
+				return
+			}
+		}
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such connection"})
+	})
+	mux.HandleFunc("DELETE /connections", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("client") == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "client is required"})
+			return
+		}
+		closed := 0
+		for _, s := range servers() {
+			for _, c := range filterConns([]*TCPServer{s}, r) {
+				if s.CloseConn(c.ID) {
+					closed++
+				}
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"closed": closed})
+	})
+	return &http.Server{Handler: mux}
+}
+
+func filterConns(servers []*TCPServer, r *http.Request) []ConnStatus {
+	listener := r.URL.Query().Get("listener")
+	client := r.URL.Query().Get("client")
+	conns := []ConnStatus{}
+	for _, s := range servers {
+		if listener != "" && listener != s.mode.String() {
+			continue
+		}
+		for _, c := range s.Conns() {
+			if client != "" && authorityHost(c.Client) != client {
+				continue
+			}
+			conns = append(conns, c)
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// checkAdminAddr refuses admin addresses reachable from other hosts: the
+// admin API has no authentication, so it listens on loopback or on a
+// unix socket
+func checkAdminAddr(addr string) error {
+	if addr == "" || !strings.Contains(addr, ":") {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("listen_admin: %v", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("listen_admin %s is not a loopback address or unix socket, the admin API has no authentication", addr)
+	}
+	return nil
+}
+
+// Listen listens on an address:port, or on a unix socket path replacing
+// a stale socket
+func Listen(addr string) (net.Listener, error) {
+	if strings.Contains(addr, ":") {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(addr)
+	}
+	return net.Listen("unix", addr)
+}
@@ -0,0 +1,146 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord is written to the audit log when a connection closes
+type AuditRecord struct {
+	ConnStatus
+	End         time.Time `json:"end"`
+	Duration    float64   `json:"duration"`     // seconds
+	CloseReason string    `json:"close_reason"` // see connInfo.closing
+	Error       string    `json:"error,omitempty"`
+}
+
+// auditLog is where the records go, nil for nowhere
+var auditLog struct {
+	mu  sync.Mutex
+	out io.WriteCloser
+}
+
+// SetupAudit opens the audit log of the config, closing the previous one.
+// Reopening on reload lets an external logrotate move the file away.
+func SetupAudit(cfg *Config) error {
+	var out io.WriteCloser
+	switch cfg.AuditLog {
+	case "":
+	case "-":
+		out = nopCloser{os.Stdout}
+	default:
+		f := &rotatingFile{path: cfg.AuditLog, maxSize: cfg.AuditMaxSize, keep: cfg.AuditKeep}
+		if err := f.open(); err != nil {
+			return fmt.Errorf("failed to open audit log, err: %v", err)
+		}
+		out = f
+	}
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+	if auditLog.out != nil {
+		auditLog.out.Close()
+	}
+	auditLog.out = out
+	return nil
+}
+
+// audit writes the completion record of a connection
+func audit(status ConnStatus, reason string, err error) {
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+	if auditLog.out == nil {
+		return
+	}
+	end := time.Now()
+	rec := AuditRecord{
+		ConnStatus:  status,
+		End:         end,
+		Duration:    end.Sub(status.Start).Seconds(),
+		CloseReason: reason,
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	b, _ := json.Marshal(rec)
+	if _, err := auditLog.out.Write(append(b, '\n')); err != nil {
+		slog.Error("failed to write audit log", "err", err)
+	}
+}
+
+// closeReason tells how a relay ended
+func closeReason(err error) string {
+	switch {
+	case err == nil:
+		return "eof"
+	case errors.Is(err, errIdleTimeout):
+		return "idle_timeout"
+	}
+	return "relay_error"
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// rotatingFile appends to path and moves it to path.1, path.2 and so on
+// once it grows past maxSize, keeping keep of them
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	f    *os.File
+	size int64
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	if r.keep > 0 {
+		for i := r.keep - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
@@ -1,32 +1,211 @@
 package router
 
 import (
+	"crypto/tls"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/ini.v1"
 	"github.com/Netflix/go-env"
 	
 )
 
-type routerConf struct {
-	ListenPlain string `ini:"listen_plain" env:"LISTEN_PLAIN"`
-	ListenTLS   string `ini:"listen_tls" env:"LISTEN_TLS"`
+// Config is the configuration of the router. Loaders build it from the
+// environment or an INI file. A config assembled in code should start from
+// GetDefaultConf and must be built with Build before use.
+type Config struct {
+	ListenPlain   string `ini:"listen_plain" env:"LISTEN_PLAIN"` // separated by comma, address:port / unix socket path, as the other listeners
+	ListenTLS     string `ini:"listen_tls" env:"LISTEN_TLS"`
+	ListenMux     string `ini:"listen_mux" env:"LISTEN_MUX"`         // TLS and plain on the same port
+	ListenMetrics string `ini:"listen_metrics" env:"LISTEN_METRICS"` // Prometheus metrics at /metrics, address:port / unix socket path
+	ListenAdmin   string `ini:"listen_admin" env:"LISTEN_ADMIN"`     // admin API, loopback address:port / unix socket path
+	ListenTunnel  string `ini:"listen_tunnel" env:"LISTEN_TUNNEL"`   // tunnels from peer routers
+	ListenWS      string `ini:"listen_ws" env:"LISTEN_WS"`           // WebSocket upgrades, e.g. behind a CDN
 	//listenQUIC    string   `ini:"listen_quic"`// TODO
 
 	FinalHTTP  string `ini:"final_http" env:"FINAL_HTTP"`   // address:port / unix socket path
 	FinalSocks string `ini:"final_socks" env:"FINAL_SOCKS"` // address:port / unix socket path
 	FinalTLS   string `ini:"final_tls" env:"FINAL_TLS"`     // address:port / unix socket path
+	FinalWS    string `ini:"final_ws" env:"FINAL_WS"`       // address:port / unix socket path, for WebSocket payloads
+
+	WSPath      string `ini:"ws_path" env:"WS_PATH"`             // the only path to accept WebSocket upgrades on, empty for any
+	WSHostParam string `ini:"ws_host_param" env:"WS_HOST_PARAM"` // query parameter to untie instead of the Host header, if present
+
+	RouteRules string `ini:"-" env:"ROUTES"` // separated by ;, see finalRoute. route keys of [routes] in ini
+	routes     []*finalRoute
+
+	FinalProxyProtocol string `ini:"final_proxy_protocol" env:"FINAL_PROXY_PROTOCOL"` // v1 / v2, announce clients to final backends
+	RedirProxyProtocol string `ini:"redir_proxy_protocol" env:"REDIR_PROXY_PROTOCOL"` // v1 / v2, announce clients to next hops
+	RedirProxyRules    string `ini:"-" env:"REDIR_PROXY_RULES"`                       // separated by ;, see proxyRule. rule keys of [redir_proxy] in ini
+	redirProxy         []*proxyRule
+
+	RestoreHost      bool `ini:"restore_host" env:"RESTORE_HOST"`             // restore the stem as HTTP/SOCKS host at the last hop, overridable per stem. not the SNI of TLS passed through
+	KeepTLSFragments bool `ini:"keep_tls_fragments" env:"KEEP_TLS_FRAGMENTS"` // re-emit ClientHello in the client's record sizes
+
+	HandshakeTimeout time.Duration `ini:"handshake_timeout" env:"HANDSHAKE_TIMEOUT"` // to receive the first request, e.g. 10s, 0 for none
+	DialTimeout      time.Duration `ini:"dial_timeout" env:"DIAL_TIMEOUT"`           // to resolve and connect the next hop, 0 for none
+	IdleTimeout      time.Duration `ini:"idle_timeout" env:"IDLE_TIMEOUT"`           // relay without data either way, 0 for none
+	ShutdownGrace    time.Duration `ini:"shutdown_grace" env:"SHUTDOWN_GRACE"`       // for connections to finish on shutdown before they are cut
+
+	ConnRate    int64  `ini:"conn_rate" env:"CONN_RATE"`       // relayed bytes/s each way of a connection, 0 for unlimited
+	ConnBurst   int64  `ini:"conn_burst" env:"CONN_BURST"`     // defaults to conn_rate
+	ClientRate  int64  `ini:"client_rate" env:"CLIENT_RATE"`   // relayed bytes/s each way of all connections of a client IP, 0 for unlimited
+	ClientBurst int64  `ini:"client_burst" env:"CLIENT_BURST"` // defaults to client_rate
+	ClassRates  string `ini:"class_rates" env:"CLASS_RATES"`   // separated by comma, <final|redirect|tunnel>=<bytes/s>[:<burst>], shared each way by the class
+	classRates  map[string][2]int64
+
+	LogLevel  string `ini:"log_level" env:"LOG_LEVEL"`   // debug / info / warn / error, defaults to info
+	LogFormat string `ini:"log_format" env:"LOG_FORMAT"` // text / json, defaults to text
+
+	AuditLog     string `ini:"audit_log" env:"AUDIT_LOG"`           // JSON record of every connection on close, file path or - for stdout, empty for none
+	AuditMaxSize int64  `ini:"audit_max_size" env:"AUDIT_MAX_SIZE"` // bytes before the audit file is rotated, 0 for never
+	AuditKeep    int    `ini:"audit_keep" env:"AUDIT_KEEP"`         // rotated audit files kept as <audit_log>.1, .2 and so on
 
 	EnableRedir  bool            `ini:"allow_redir" env:"ALLOW_REDIR"` // whether or not redir is enabled
 	AllowPorts   string          `ini:"allow_ports" env:"ALLOW_PORTS"` // separated by comma, concatenated with -. eg. 80,443,10000-65535
 	AllowPortmap [65536 / 8]byte `ini:"-,omitempty"  env:"-"`
+	ACLRules     string          `ini:"-" env:"ACL"` // separated by ;, see aclRule. rule keys of [acl] in ini
+	acl          []*aclRule
+
+	UpstreamProxy string `ini:"upstream_proxy" env:"UPSTREAM_PROXY"` // egress proxy for redirect and final dials, socks5:// or http:// URL
+	UpstreamRules string `ini:"-" env:"UPSTREAMS"`                   // separated by ;, see upstreamRule. rule keys of [upstreams] in ini
+	upstreams     []*upstreamRule
+	upstream      *url.URL
+
+	TunnelSecret   string `ini:"tunnel_secret" env:"TUNNEL_SECRET"`       // shared by the routers tunnelling to each other
+	TunnelPeers    string `ini:"tunnel_peers" env:"TUNNEL_PEERS"`         // separated by comma, <knot host:port>=<tunnel address:port>
+	TunnelPoolSize int    `ini:"tunnel_pool_size" env:"TUNNEL_POOL_SIZE"` // tunnels kept to each peer, 0 for the default
+	tunnelPeers    map[string]string
+
+	Stems map[string]*StemConfig `ini:"-" env:"-"` // [stem:<hostname>] sections, by lower case hostname
+
+	Listener  ListenerConfig                 `ini:"-"`
+	Listeners map[ListenMode]*ListenerConfig `ini:"-" env:"-"` // [listen_<mode>] sections
+}
+
+// ListenerConfig holds the options that may differ between listeners,
+// defaulting to the global ones of Config.Listener. The connection limits
+// are shared by all the addresses of a listener mode.
+type ListenerConfig struct {
+	AcceptProxy bool `ini:"accept_proxy" env:"ACCEPT_PROXY"` // require a PROXY protocol v1/v2 header from clients
+
+	ClientAllow   string  `ini:"client_allow" env:"CLIENT_ALLOW"`         // IPs/CIDRs separated by comma, empty allows all
+	ClientDeny    string  `ini:"client_deny" env:"CLIENT_DENY"`           // IPs/CIDRs separated by comma, checked first
+	MaxConns      int     `ini:"max_conns" env:"MAX_CONNS"`               // concurrent connections, 0 for unlimited
+	MaxConnsPerIP int     `ini:"max_conns_per_ip" env:"MAX_CONNS_PER_IP"` // concurrent connections of a client IP, 0 for unlimited
+	AcceptRate    float64 `ini:"accept_rate" env:"ACCEPT_RATE"`           // accepted connections per second, 0 for unlimited
+	AcceptBurst   int     `ini:"accept_burst" env:"ACCEPT_BURST"`         // defaults to accept_rate
+
+	Sniffers string `ini:"sniffers" env:"SNIFFERS"` // separated by comma, tried in order, e.g. socks5,http. empty for those of the listener
+
+	clientAllow []*net.IPNet
+	clientDeny  []*net.IPNet
+	sniffers    []Sniffer
+}
+
+func (lc *ListenerConfig) BuildClientLists() (err error) {
+	if lc.clientAllow, err = parseCIDRs(lc.ClientAllow); err != nil {
+		return fmt.Errorf("invalid client_allow, err: %v", err)
+	}
+	if lc.clientDeny, err = parseCIDRs(lc.ClientDeny); err != nil {
+		return fmt.Errorf("invalid client_deny, err: %v", err)
+	}
+	return nil
+}
+
+// ListenAddrs returns the addresses to listen on in mode
+func (c *Config) ListenAddrs(mode ListenMode) []string {
+	var list string
+	switch mode {
+	case ModePlain:
+		list = c.ListenPlain
+	case ModeTLS:
+		list = c.ListenTLS
+	case ModeMux:
+		list = c.ListenMux
+	case ModeTunnel:
+		list = c.ListenTunnel
+	case ModeWebSocket:
+		list = c.ListenWS
+	}
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
 }
 
-func (c *routerConf) BuildPortmap() error {
+func (c *Config) ListenerConf(mode ListenMode) *ListenerConfig {
+	if lc, ok := c.Listeners[mode]; ok {
+		return lc
+	}
+	return &c.Listener
+}
+
+// StemConfig holds the options of a stem hostname, defaulting to the global ones
+type StemConfig struct {
+	// RestoreHost restores the stem as HTTP/SOCKS host at the last hop. The
+	// SNI of TLS passed through to final_tls keeps its knots: the
+	// ClientHello is part of the handshake transcript, so the backend and
+	// the client would disagree on it. Terminate TLS with tls_cert for the
+	// host inside to be restored.
+	RestoreHost bool   `ini:"restore_host"`
+	TLSCert     string `ini:"tls_cert"` // PEM certificate chain to terminate TLS for the stem
+	TLSKey      string `ini:"tls_key"`  // PEM private key of tls_cert
+
+	// Certificate terminates TLS for the stem, loaded from tls_cert and
+	// tls_key when they are set
+	Certificate *tls.Certificate `ini:"-"`
+}
+
+func (c *Config) StemConf(stem string) *StemConfig {
+	if sc, ok := c.Stems[strings.ToLower(stem)]; ok {
+		return sc
+	}
+	return &StemConfig{RestoreHost: c.RestoreHost}
+}
+
+// warnRestoreHost warns that restore_host leaves alone the SNI of TLS
+// passed through to final_tls
+func (c *Config) warnRestoreHost() {
+	if c.FinalTLS == "" {
+		return
+	}
+	restoring := c.RestoreHost
+	for _, sc := range c.Stems {
+		restoring = restoring || sc.RestoreHost && sc.Certificate == nil
+	}
+	if restoring {
+		slog.Warn("restore_host does not restore the SNI of TLS passed through to final_tls, set tls_cert to terminate it")
+	}
+}
+
+// BuildStems keys Stems by lower case hostname, as StemConf looks them up
+func (c *Config) BuildStems() {
+	if c.Stems == nil {
+		return
+	}
+	stems := make(map[string]*StemConfig, len(c.Stems))
+	for stem, sc := range c.Stems {
+		stems[strings.ToLower(strings.TrimSpace(stem))] = sc
+	}
+	c.Stems = stems
+}
+
+func (c *Config) BuildPortmap() error {
 	// Clear up
 	c.AllowPortmap = [len(c.AllowPortmap)]byte{}
+	if strings.TrimSpace(c.AllowPorts) == "" {
+		// No port for redirects
+		return nil
+	}
 	allowports := strings.Split(c.AllowPorts, ",")
 	for _, portr := range allowports {
 		floor, ceil, ok := strings.Cut(portr, "-")
@@ -72,33 +251,120 @@ func (c *routerConf) BuildPortmap() error {
 	return nil
 }
 
-func (c *routerConf) IsPortAllowed(port uint16) bool {
+func (c *Config) IsPortAllowed(port uint16) bool {
 	pos, rem := int(port/8), byte(port%8)
 	return (c.AllowPortmap[pos] & (byte(1) << rem)) != 0
 }
 
-func GetDefaultConf() *routerConf {
-	return &routerConf{}
+func (c *Config) Validate() error {
+	if err := checkProxyVersion(c.FinalProxyProtocol); err != nil {
+		return err
+	}
+	if err := checkProxyVersion(c.RedirProxyProtocol); err != nil {
+		return err
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if err := checkLogFormat(c.LogFormat); err != nil {
+		return err
+	}
+	if err := checkAdminAddr(c.ListenAdmin); err != nil {
+		return err
+	}
+	if c.ConnRate < 0 || c.ConnBurst < 0 || c.ClientRate < 0 || c.ClientBurst < 0 {
+		return fmt.Errorf("bandwidth rates and bursts must not be negative")
+	}
+	if err := c.BuildClassRates(); err != nil {
+		return err
+	}
+	if c.AuditMaxSize < 0 || c.AuditKeep < 0 {
+		return fmt.Errorf("audit_max_size and audit_keep must not be negative")
+	}
+	if c.TunnelPoolSize < 0 {
+		return fmt.Errorf("tunnel_pool_size must not be negative")
+	}
+	if c.TunnelPoolSize == 0 {
+		c.TunnelPoolSize = defaultTunnelPoolSize
+	}
+	if err := c.BuildTunnelPeers(); err != nil {
+		return err
+	}
+	if err := c.BuildCertificates(); err != nil {
+		return err
+	}
+	c.warnRestoreHost()
+	if err := c.Listener.BuildClientLists(); err != nil {
+		return err
+	}
+	if err := c.Listener.BuildSniffers(); err != nil {
+		return err
+	}
+	for mode, lc := range c.Listeners {
+		if err := lc.BuildClientLists(); err != nil {
+			return fmt.Errorf("[listen_%s] %v", mode, err)
+		}
+		if err := lc.BuildSniffers(); err != nil {
+			return fmt.Errorf("[listen_%s] %v", mode, err)
+		}
+	}
+	return nil
+}
+
+// defaultTunnelPoolSize is the number of tunnels kept to each peer
+const defaultTunnelPoolSize = 2
+
+func GetDefaultConf() *Config {
+	return &Config{
+		HandshakeTimeout: 10 * time.Second,
+		DialTimeout:      10 * time.Second,
+		ShutdownGrace:    10 * time.Second,
+		TunnelPoolSize:   defaultTunnelPoolSize,
+		AuditMaxSize:     100 << 20,
+		AuditKeep:        5,
+	}
 }
 
-func LoadAllConfsFromEnv() (*routerConf, error) {
+// Build parses the rule and port lists of the config and validates it
+func (c *Config) Build() error {
+	if err := c.BuildPortmap(); err != nil {
+		return fmt.Errorf("failed to build port bit map, err: %v", err)
+	}
+	if err := c.BuildRoutes(); err != nil {
+		return fmt.Errorf("failed to build routes, err: %v", err)
+	}
+	if err := c.BuildACL(); err != nil {
+		return fmt.Errorf("failed to build acl, err: %v", err)
+	}
+	if err := c.BuildUpstreams(); err != nil {
+		return fmt.Errorf("failed to build upstreams, err: %v", err)
+	}
+	if err := c.BuildRedirProxyRules(); err != nil {
+		return fmt.Errorf("failed to build redir proxy rules, err: %v", err)
+	}
+	c.BuildStems()
+	return c.Validate()
+}
+
+func LoadAllConfsFromEnv() (*Config, error) {
 	cfg := GetDefaultConf()
 	if _, err := env.UnmarshalFromEnviron(cfg); err != nil {
 		return nil, err
 	}
-	if err := cfg.BuildPortmap(); err != nil {
-		return nil, fmt.Errorf("failed to build port bit map, err: %v", err)
+	if err := cfg.Build(); err != nil {
+		return nil, err
 	}
 	return cfg, nil
 }
 
-func LoadAllConfsFromIni(source interface{}) (*routerConf, error) {
+func LoadAllConfsFromIni(source interface{}) (*Config, error) {
 	f, err := ini.LoadSources(ini.LoadOptions{
 		Insensitive:         true,
 		InsensitiveSections: true,
 		InsensitiveKeys:     true,
 		IgnoreInlineComment: true,
 		AllowBooleanKeys:    true,
+		AllowShadows:        true,
 	}, source)
 	if err != nil {
 		return nil, err
@@ -117,9 +383,76 @@ func LoadAllConfsFromIni(source interface{}) (*routerConf, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := s.MapTo(&cfg.Listener); err != nil {
+		return nil, err
+	}
+	for _, mode := range []ListenMode{ModePlain, ModeTLS, ModeMux, ModeTunnel, ModeWebSocket} {
+		ls, err := f.GetSection("listen_" + mode.String())
+		if err != nil {
+			continue
+		}
+		lc := cfg.Listener
+		if err := ls.MapTo(&lc); err != nil {
+			return nil, fmt.Errorf("failed to parse section [%s], err: %v", ls.Name(), err)
+		}
+		if cfg.Listeners == nil {
+			cfg.Listeners = make(map[ListenMode]*ListenerConfig)
+		}
+		cfg.Listeners[mode] = &lc
+	}
+	for _, section := range f.Sections() {
+		stem, ok := strings.CutPrefix(section.Name(), "stem:")
+		if !ok {
+			continue
+		}
+		sc := cfg.StemConf("")
+		if err := section.MapTo(sc); err != nil {
+			return nil, fmt.Errorf("failed to parse section [%s], err: %v", section.Name(), err)
+		}
+		if cfg.Stems == nil {
+			cfg.Stems = make(map[string]*StemConfig)
+		}
+		cfg.Stems[stem] = sc
+	}
 	if err := cfg.BuildPortmap(); err != nil {
 		return nil, fmt.Errorf("failed to build port bit map, err: %v", err)
 	}
+	if err := cfg.BuildRoutes(); err != nil {
+		return nil, fmt.Errorf("failed to build routes, err: %v", err)
+	}
+	if err := cfg.BuildACL(); err != nil {
+		return nil, fmt.Errorf("failed to build acl, err: %v", err)
+	}
+	if err := cfg.BuildUpstreams(); err != nil {
+		return nil, fmt.Errorf("failed to build upstreams, err: %v", err)
+	}
+	if err := cfg.BuildRedirProxyRules(); err != nil {
+		return nil, fmt.Errorf("failed to build redir proxy rules, err: %v", err)
+	}
+	cfg.BuildStems()
+	if s, err := f.GetSection("acl"); err == nil {
+		if err := cfg.addACLRules(s.Key("rule").ValueWithShadows()); err != nil {
+			return nil, fmt.Errorf("failed to parse section [acl], err: %v", err)
+		}
+	}
+	if s, err := f.GetSection("upstreams"); err == nil {
+		if err := cfg.addUpstreamRules(s.Key("rule").ValueWithShadows()); err != nil {
+			return nil, fmt.Errorf("failed to parse section [upstreams], err: %v", err)
+		}
+	}
+	if s, err := f.GetSection("redir_proxy"); err == nil {
+		if err := cfg.addRedirProxyRules(s.Key("rule").ValueWithShadows()); err != nil {
+			return nil, fmt.Errorf("failed to parse section [redir_proxy], err: %v", err)
+		}
+	}
+	if s, err := f.GetSection("routes"); err == nil {
+		if err := cfg.addRoutes(s.Key("route").ValueWithShadows()); err != nil {
+			return nil, fmt.Errorf("failed to parse section [routes], err: %v", err)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 
 	return cfg, nil
 }
@@ -0,0 +1,78 @@
+package router
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBuildCodeConfig(t *testing.T) {
+	c := &Config{
+		FinalHTTP: "127.0.0.1:8080",
+		Stems:     map[string]*StemConfig{"Example.COM": {RestoreHost: true}},
+		Listeners: map[ListenMode]*ListenerConfig{ModePlain: {MaxConns: 10, Sniffers: "http"}},
+	}
+	if err := c.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if c.IsPortAllowed(80) {
+		t.Error("port 80 allowed without allow_ports")
+	}
+	if c.TunnelPoolSize != defaultTunnelPoolSize {
+		t.Errorf("TunnelPoolSize = %d, want %d", c.TunnelPoolSize, defaultTunnelPoolSize)
+	}
+	if !c.StemConf("example.com").RestoreHost {
+		t.Error("stem options not kept")
+	}
+	if lc := c.ListenerConf(ModePlain); len(lc.sniffers) != 1 {
+		t.Errorf("listener sniffers = %v, want http", lc.sniffers)
+	}
+}
+
+func TestRedirProxyVersion(t *testing.T) {
+	c, err := LoadAllConfsFromIni([]byte(`
+allow_ports = 443
+redir_proxy_protocol = v1
+
+[redir_proxy]
+rule = v2 hop.example.com
+rule = none 10.0.0.0/8 443
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		ips  []net.IP
+		port uint16
+		want string
+	}{
+		{"hop.example.com", nil, 443, "v2"},
+		{"a.hop.example.com", []net.IP{net.ParseIP("192.0.2.1")}, 443, "v2"},
+		{"10.1.2.3", []net.IP{net.ParseIP("10.1.2.3")}, 443, "none"},
+		{"10.1.2.3", []net.IP{net.ParseIP("10.1.2.3")}, 8443, "v1"},
+		{"other.example.com", nil, 443, "v1"},
+	}
+	for _, tt := range tests {
+		if got := c.RedirProxyVersion(tt.host, tt.ips, tt.port); got != tt.want {
+			t.Errorf("RedirProxyVersion(%q, %v, %d) = %q, want %q", tt.host, tt.ips, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestCheckAdminAddr(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"":                  true,
+		"/run/quipu.sock":   true,
+		"127.0.0.1:9000":    true,
+		"[::1]:9000":        true,
+		"localhost:9000":    true,
+		":9000":             false,
+		"0.0.0.0:9000":      false,
+		"192.0.2.1:9000":    false,
+		"admin.example:900": false,
+	} {
+		if err := checkAdminAddr(addr); (err == nil) != ok {
+			t.Errorf("checkAdminAddr(%q) = %v, want ok %v", addr, err, ok)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Options configure a TCPServer embedded in another program
+type Options struct {
+	Mode   ListenMode
+	Config *Config // required, built with Build
+	Hooks  Hooks   // optional
+}
+
+// New returns a server for opts, to be served with ServeContext or Serve.
+// Its config may be swapped later with SetConf.
+func New(opts Options) (*TCPServer, error) {
+	if opts.Config == nil {
+		return nil, errors.New("router: a config is required")
+	}
+	if opts.Mode == ModeTunnel && opts.Config.TunnelSecret == "" {
+		return nil, errNoTunnelSecret
+	}
+	s := NewTCPServer("", opts.Mode, opts.Config)
+	s.hooks = opts.Hooks
+	return s, nil
+}
+
+// ServeContext serves ln until ctx is done, then shuts down within the
+// shutdown grace of the config and returns nil
+func (s *TCPServer) ServeContext(ctx context.Context, ln net.Listener) error {
+	done := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		s.Shutdown(s.conf().ShutdownGrace)
+		close(done)
+	})
+	err := s.Serve(ln)
+	if !stop() {
+		<-done
+	}
+	return err
+}
+
+// Route is where a connection goes once untied
+type Route struct {
+	Listener string
+	Client   net.Addr
+	Proto    string
+	OrigHost string // as received
+	Hostname string // as passed on
+	Knot     string // host:port of the next hop, empty at the end of the chain
+	Backend  string // final backend, address:port or unix socket path
+}
+
+// Hooks let an embedder add auth, accounting or routing around the handling
+// of each connection. Embed NopHooks to implement only some of them.
+type Hooks interface {
+	// Accepted is called before a connection is sniffed, an error rejects it
+	Accepted(ctx context.Context, conn net.Conn) error
+	// Untied is called with the route untied from a connection, an error
+	// rejects it. Setting Backend sends the connection there as final.
+	Untied(ctx context.Context, r *Route) error
+	// Dial connects to the next hop or final backend of r in place of the
+	// router, which dials itself when no conn and no error are returned
+	Dial(ctx context.Context, r *Route) (net.Conn, error)
+	// Closed is called once a connection is done, with the error that ended
+	// its relay if any
+	Closed(status ConnStatus, err error)
+}
+
+// NopHooks does nothing
+type NopHooks struct{}
+
+func (NopHooks) Accepted(ctx context.Context, conn net.Conn) error    { return nil }
+func (NopHooks) Untied(ctx context.Context, r *Route) error           { return nil }
+func (NopHooks) Dial(ctx context.Context, r *Route) (net.Conn, error) { return nil, nil }
+func (NopHooks) Closed(status ConnStatus, err error)                  {}
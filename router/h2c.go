@@ -0,0 +1,379 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/Max-Sum/quipu/knotchain"
+	"golang.org/x/net/http2/hpack"
+)
+
+const h2cPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	h2FrameHeaderLen    = 9
+	h2DefaultFrameSize  = 16384
+	h2DefaultTableSize  = 4096
+	h2MaxPreludeFrames  = 16
+	h2FrameHeaders      = 0x1
+	h2FrameContinuation = 0x9
+
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded     = 0x8
+	h2FlagPriority   = 0x20
+)
+
+type h2Frame struct {
+	typ      byte
+	flags    byte
+	streamID uint32
+	payload  []byte
+}
+
+func readH2Frame(r io.Reader) (*h2Frame, error) {
+	hdr := make([]byte, h2FrameHeaderLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	length := int(hdr[0])<<16 | int(hdr[1])<<8 | int(hdr[2])
+	// The client may not exceed the default frame size before our SETTINGS
+	if length > h2DefaultFrameSize {
+		return nil, fmt.Errorf("h2c: frame too large: %d", length)
+	}
+	f := &h2Frame{
+		typ:      hdr[3],
+		flags:    hdr[4],
+		streamID: binary.BigEndian.Uint32(hdr[5:]) & 0x7fffffff,
+		payload:  make([]byte, length),
+	}
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *h2Frame) WriteTo(w io.Writer) (int64, error) {
+	hdr := make([]byte, h2FrameHeaderLen)
+	hdr[0], hdr[1], hdr[2] = byte(len(f.payload)>>16), byte(len(f.payload)>>8), byte(len(f.payload))
+	hdr[3] = f.typ
+	hdr[4] = f.flags
+	binary.BigEndian.PutUint32(hdr[5:], f.streamID)
+	n, err := w.Write(hdr)
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := w.Write(f.payload)
+	return int64(n + m), err
+}
+
+// untieH2CHost unties the :authority of the first request of a
+// prior-knowledge HTTP/2 connection. Frames sent ahead of the first
+// HEADERS frame (SETTINGS, WINDOW_UPDATE, ...) are passed through as-is.
+func (s *TCPServer) untieH2CHost(r *bufio.Reader) (*Untied, error) {
+	preface := make([]byte, len(h2cPreface))
+	if _, err := io.ReadFull(r, preface); err != nil {
+		return nil, err
+	}
+	if string(preface) != h2cPreface {
+		return nil, fmt.Errorf("h2c: bad connection preface")
+	}
+	buf := &bytes.Buffer{}
+	buf.Write(preface)
+
+	var headers *h2Frame
+	for i := 0; headers == nil; i++ {
+		if i >= h2MaxPreludeFrames {
+			return nil, fmt.Errorf("h2c: no HEADERS frame in the first %d frames", h2MaxPreludeFrames)
+		}
+		f, err := readH2Frame(r)
+		if err != nil {
+			return nil, err
+		}
+		if f.typ == h2FrameContinuation {
+			return nil, fmt.Errorf("h2c: unexpected CONTINUATION frame")
+		}
+		if f.typ != h2FrameHeaders {
+			f.WriteTo(buf)
+			continue
+		}
+		headers = f
+	}
+
+	// Strip padding and priority off the header block fragment
+	fragment := headers.payload
+	if headers.flags&h2FlagPadded != 0 {
+		if len(fragment) < 1 || int(fragment[0]) >= len(fragment) {
+			return nil, fmt.Errorf("h2c: bad padding")
+		}
+		fragment = fragment[1 : len(fragment)-int(fragment[0])]
+	}
+	var priority []byte
+	if headers.flags&h2FlagPriority != 0 {
+		if len(fragment) < 5 {
+			return nil, fmt.Errorf("h2c: bad priority")
+		}
+		priority, fragment = fragment[:5], fragment[5:]
+	}
+	block := append([]byte{}, fragment...)
+	for flags := headers.flags; flags&h2FlagEndHeaders == 0; {
+		f, err := readH2Frame(r)
+		if err != nil {
+			return nil, err
+		}
+		if f.typ != h2FrameContinuation || f.streamID != headers.streamID {
+			return nil, fmt.Errorf("h2c: expected CONTINUATION frame")
+		}
+		block = append(block, f.payload...)
+		flags = f.flags
+	}
+
+	u := &Untied{Proto: "h2c"}
+	block, err := s.untieHPACKAuthority(block, u)
+	if err != nil && err != knotchain.ErrNoKnotToUntie {
+		return nil, err
+	}
+
+	// Re-emit the header block, dropping padding
+	first := make([]byte, 0, len(priority)+len(block))
+	first = append(append(first, priority...), block...)
+	flags := headers.flags &^ (h2FlagPadded | h2FlagEndHeaders)
+	typ := byte(h2FrameHeaders)
+	for {
+		size := h2DefaultFrameSize
+		if len(first) <= size {
+			size = len(first)
+			flags |= h2FlagEndHeaders
+		}
+		f := &h2Frame{typ: typ, flags: flags, streamID: headers.streamID, payload: first[:size]}
+		f.WriteTo(buf)
+		if flags&h2FlagEndHeaders != 0 {
+			break
+		}
+		first = first[size:]
+		typ, flags = h2FrameContinuation, 0
+	}
+	u.Readahead = buf.Bytes()
+	return u, err
+}
+
+// untieHPACKAuthority rewrites :authority (and host) in a header block,
+// keeping every other representation byte-for-byte so the decoder's
+// dynamic table on the far side stays in step with the client's encoder.
+// A rewritten field keeps its indexing mode, so its table entry must not
+// grow: the far side would evict entries the client still refers to in
+// later header blocks. A smaller entry only delays evictions there, past
+// the last index the client can use. Untying keeps the length of a host
+// and restoring a stem shortens it, a growing entry fails the handshake.
+// The hosts and the next knot are filled in u.
+func (s *TCPServer) untieHPACKAuthority(block []byte, u *Untied) ([]byte, error) {
+	var authority, origAuthority string
+	var nextKnot knotchain.Knot
+	err := knotchain.ErrNoKnotToUntie
+	seen := make(map[string]string)
+	table := &hpackNameTable{maxSize: h2DefaultTableSize}
+	out := make([]byte, 0, len(block))
+
+	for p := block; len(p) > 0; {
+		b := p[0]
+		switch {
+		case b&0x80 != 0: // Indexed
+			_, rest, e := readHPACKInt(7, p)
+			if e != nil {
+				return nil, e
+			}
+			out = append(out, p[:len(p)-len(rest)]...)
+			p = rest
+			continue
+		case b&0xe0 == 0x20: // Dynamic table size update
+			size, rest, e := readHPACKInt(5, p)
+			if e != nil {
+				return nil, e
+			}
+			table.setMaxSize(size)
+			out = append(out, p[:len(p)-len(rest)]...)
+			p = rest
+			continue
+		}
+
+		// Literal representations
+		prefix, indexing := uint8(4), false
+		if b&0xc0 == 0x40 {
+			prefix, indexing = 6, true
+		}
+		idx, rest, e := readHPACKInt(prefix, p)
+		if e != nil {
+			return nil, e
+		}
+		var name string
+		if idx == 0 {
+			if name, rest, e = readHPACKString(rest); e != nil {
+				return nil, e
+			}
+		} else if name, e = table.name(idx); e != nil {
+			return nil, e
+		}
+		nameRaw := p[:len(p)-len(rest)]
+		value, rest, e := readHPACKString(rest)
+		if e != nil {
+			return nil, e
+		}
+		if name == ":authority" || name == "host" {
+			newValue, ok := seen[value]
+			if !ok {
+				var k knotchain.Knot
+				var ke error
+				k, newValue, ke = s.UntieAuthority(value)
+				if ke != nil && ke != knotchain.ErrNoKnotToUntie {
+					return nil, ke
+				}
+				if nextKnot == nil && k != nil {
+					nextKnot, err = k, ke
+				}
+				seen[value] = newValue
+			}
+			if indexing && len(newValue) > len(value) {
+				return nil, fmt.Errorf("h2c: untied %s outgrows its HPACK table entry", name)
+			}
+			if name == ":authority" || authority == "" {
+				authority, origAuthority = newValue, value
+			}
+			value = newValue
+			out = append(out, nameRaw...)
+			out = appendHPACKString(out, value)
+		} else {
+			out = append(out, p[:len(p)-len(rest)]...)
+		}
+		if indexing {
+			table.add(name, value)
+		}
+		p = rest
+	}
+	u.Hostname = authorityHost(authority)
+	u.OrigHost = authorityHost(origAuthority)
+	u.NextKnot = nextKnot
+	return out, err
+}
+
+// hpackNameTable tracks the names held in the decoder's dynamic table, as
+// far as the first header block is concerned.
+type hpackNameTable struct {
+	names   []string // newest first
+	sizes   []uint64
+	size    uint64
+	maxSize uint64
+}
+
+func (t *hpackNameTable) setMaxSize(size uint64) {
+	t.maxSize = size
+	t.evict()
+}
+
+func (t *hpackNameTable) add(name, value string) {
+	t.names = append([]string{name}, t.names...)
+	t.sizes = append([]uint64{uint64(len(name) + len(value) + 32)}, t.sizes...)
+	t.size += t.sizes[0]
+	t.evict()
+}
+
+func (t *hpackNameTable) evict() {
+	for t.size > t.maxSize && len(t.names) > 0 {
+		last := len(t.names) - 1
+		t.size -= t.sizes[last]
+		t.names, t.sizes = t.names[:last], t.sizes[:last]
+	}
+}
+
+func (t *hpackNameTable) name(idx uint64) (string, error) {
+	if idx <= uint64(len(hpackStaticNames)) {
+		return hpackStaticNames[idx-1], nil
+	}
+	idx -= uint64(len(hpackStaticNames)) + 1
+	if idx >= uint64(len(t.names)) {
+		return "", fmt.Errorf("hpack: invalid index")
+	}
+	return t.names[idx], nil
+}
+
+func readHPACKInt(prefix uint8, p []byte) (uint64, []byte, error) {
+	if len(p) == 0 {
+		return 0, nil, fmt.Errorf("hpack: truncated integer")
+	}
+	mask := uint64(1)<<prefix - 1
+	i := uint64(p[0]) & mask
+	p = p[1:]
+	if i < mask {
+		return i, p, nil
+	}
+	for m := uint(0); len(p) > 0; m += 7 {
+		if m > 56 {
+			return 0, nil, fmt.Errorf("hpack: integer overflow")
+		}
+		b := p[0]
+		p = p[1:]
+		i += uint64(b&0x7f) << m
+		if b&0x80 == 0 {
+			return i, p, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("hpack: truncated integer")
+}
+
+func readHPACKString(p []byte) (string, []byte, error) {
+	if len(p) == 0 {
+		return "", nil, fmt.Errorf("hpack: truncated string")
+	}
+	huffman := p[0]&0x80 != 0
+	length, p, err := readHPACKInt(7, p)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(p)) < length {
+		return "", nil, fmt.Errorf("hpack: truncated string")
+	}
+	s, p := p[:length], p[length:]
+	if !huffman {
+		return string(s), p, nil
+	}
+	v, err := hpack.HuffmanDecodeToString(s)
+	return v, p, err
+}
+
+func appendHPACKInt(dst []byte, first byte, prefix uint8, i uint64) []byte {
+	mask := uint64(1)<<prefix - 1
+	if i < mask {
+		return append(dst, first|byte(i))
+	}
+	dst = append(dst, first|byte(mask))
+	for i -= mask; i >= 0x80; i >>= 7 {
+		dst = append(dst, byte(i&0x7f)|0x80)
+	}
+	return append(dst, byte(i))
+}
+
+func appendHPACKString(dst []byte, s string) []byte {
+	if l := hpack.HuffmanEncodeLength(s); l < uint64(len(s)) {
+		dst = appendHPACKInt(dst, 0x80, 7, l)
+		return hpack.AppendHuffmanString(dst, s)
+	}
+	dst = appendHPACKInt(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// Names of the HPACK static table (RFC 7541, Appendix A)
+var hpackStaticNames = [...]string{
+	":authority", ":method", ":method", ":path", ":path", ":scheme", ":scheme",
+	":status", ":status", ":status", ":status", ":status", ":status", ":status",
+	"accept-charset", "accept-encoding", "accept-language", "accept-ranges",
+	"accept", "access-control-allow-origin", "age", "allow", "authorization",
+	"cache-control", "content-disposition", "content-encoding",
+	"content-language", "content-length", "content-location", "content-range",
+	"content-type", "cookie", "date", "etag", "expect", "expires", "from", "host",
+	"if-match", "if-modified-since", "if-none-match", "if-range",
+	"if-unmodified-since", "last-modified", "link", "location", "max-forwards",
+	"proxy-authenticate", "proxy-authorization", "range", "referer", "refresh",
+	"retry-after", "server", "set-cookie", "strict-transport-security",
+	"transfer-encoding", "user-agent", "vary", "via", "www-authenticate",
+}
@@ -0,0 +1,88 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Max-Sum/quipu/knotchain"
+	"github.com/Max-Sum/quipu/knotchain/knot"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestUntieHPACKAuthority(t *testing.T) {
+	hostname, err := knotchain.TieChainToHostname(&knotchain.KnotChain{
+		Version: knotchain.Version1,
+		Knots:   []knotchain.Knot{&knot.Domain{Addr: "backend.example", IPort: 443}},
+	}, "stem.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewTCPServer("", ModePlain, GetDefaultConf())
+	for _, authority := range []string{hostname + ":443", "[" + hostname + "]:443"} {
+		t.Run(authority, func(t *testing.T) {
+			// The first block fills the dynamic table to the byte, so an
+			// entry grown by the rewrite would evict :authority on the far
+			// side while the client still refers to it
+			fields := []hpack.HeaderField{{Name: ":method", Value: "GET"}, {Name: ":authority", Value: authority}}
+			free := h2DefaultTableSize - (len(":authority") + len(authority) + 32)
+			for i := 0; free > 0; i++ {
+				f := hpack.HeaderField{Name: fmt.Sprintf("x-pad-%02d", i)}
+				size := 100
+				if free < 2*size {
+					size = free
+				}
+				f.Value = strings.Repeat("v", size-len(f.Name)-32)
+				fields = append(fields, f)
+				free -= size
+			}
+			var buf bytes.Buffer
+			enc := hpack.NewEncoder(&buf)
+			block := func(fields []hpack.HeaderField) []byte {
+				buf.Reset()
+				for _, f := range fields {
+					enc.WriteField(f)
+				}
+				return append([]byte{}, buf.Bytes()...)
+			}
+
+			u := &Untied{}
+			rewritten, err := s.untieHPACKAuthority(block(fields), u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.OrigHost != hostname || u.Hostname == hostname {
+				t.Errorf("untied %q to %q", u.OrigHost, u.Hostname)
+			}
+			var got []hpack.HeaderField
+			dec := hpack.NewDecoder(h2DefaultTableSize, func(f hpack.HeaderField) { got = append(got, f) })
+			if _, err := dec.Write(rewritten); err != nil {
+				t.Fatalf("rewritten block: %v", err)
+			}
+			untied := got[1].Value
+			if authorityHost(untied) != u.Hostname {
+				t.Errorf(":authority = %q, want host %q", untied, u.Hostname)
+			}
+			// Later blocks go through untouched, indexing into the table
+			// left by the rewritten one
+			for i := 0; i < 2; i++ {
+				got = nil
+				if _, err := dec.Write(block(fields)); err != nil {
+					t.Fatalf("block %d after the rewrite: %v", i+2, err)
+				}
+				if len(got) != len(fields) {
+					t.Fatalf("block %d: %d fields, want %d", i+2, len(got), len(fields))
+				}
+				for j, f := range fields {
+					if f.Name == ":authority" {
+						f.Value = untied
+					}
+					if got[j] != f {
+						t.Errorf("block %d field %d = %v, want %v", i+2, j, got[j], f)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package router
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// serveTest serves cfg on a loopback listener of mode until the test ends
+func serveTest(t *testing.T, mode ListenMode, cfg *Config) string {
+	t.Helper()
+	if err := cfg.Build(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Options{Mode: mode, Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Shutdown(0) })
+	return ln.Addr().String()
+}
+
+func TestHandleMalformed(t *testing.T) {
+	inputs := map[string]string{
+		"garbage":      "GARBAGE\r\n\r\n",
+		"bad http":     "GET / HTTP/1.1\r\nHost: q--!!!.stem\r\n\r\n",
+		"empty knot":   "GET / HTTP/1.1\r\nHost: q--.stem\r\n\r\n",
+		"short knot":   "GET / HTTP/1.1\r\nHost: q--ae.stem\r\n\r\n",
+		"socks5 knot":  "\x05\x01\x00\x05\x01\x00\x03\x08q--.stem\x01\xbb",
+		"no host":      "GET / HTTP/1.1\r\n\r\n",
+		"bad hello":    "\x16\x03\x01\x00\x05hello",
+		"short hello":  "\x16\x03\x01\x00\x40\x01\x00\x00\x3c\x03\x03",
+		"bad socks4":   "\x04\x01\x00\x50\x00\x00\x00\x01\x00",
+		"bad socks5":   "\x05\x01\x00\x05\x01\x00\x03\xff",
+		"bad h2c":      "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n\x00\x00\x04\x01\x04\x00\x00\x00\x01\xff\xff\xff\xff",
+		"bad ws":       "GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n",
+		"empty":        "",
+		"single byte":  "\x00",
+		"high byte":    "\xff\xff\xff\xff",
+		"lower method": "get / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	}
+	for _, mode := range []ListenMode{ModePlain, ModeTLS, ModeMux, ModeWebSocket} {
+		t.Run(mode.String(), func(t *testing.T) {
+			cfg := GetDefaultConf()
+			cfg.HandshakeTimeout = time.Second
+			addr := serveTest(t, mode, cfg)
+			for name, input := range inputs {
+				c, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				c.Write([]byte(input))
+				c.(*net.TCPConn).CloseWrite()
+				// The router answers or gives up, but has to stay up
+				c.SetReadDeadline(time.Now().Add(3 * time.Second))
+				if _, err := io.Copy(io.Discard, c); err != nil {
+					t.Errorf("%s: connection not closed: %v", name, err)
+				}
+				c.Close()
+			}
+		})
+	}
+}
+
+func TestMaxConnsSharedByMode(t *testing.T) {
+	cfg := GetDefaultConf()
+	cfg.Listener.MaxConns = 1
+	first, second := serveTest(t, ModePlain, cfg), serveTest(t, ModePlain, cfg)
+	held, err := net.Dial("tcp", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	l := limiterFor(ModePlain)
+	for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		l.mu.Lock()
+		total := l.total
+		l.mu.Unlock()
+		if total == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("first connection not admitted")
+		}
+	}
+	c, err := net.Dial("tcp", second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Rejected at once, long before the handshake timeout
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.Copy(io.Discard, c); err != nil {
+		t.Errorf("connection over max_conns on another address not rejected: %v", err)
+	}
+}
+
+// closedLog catches the bytes_down of the "closed" log lines
+type closedLog struct {
+	slog.Handler
+	down chan int64
+}
+
+func (h *closedLog) Handle(ctx context.Context, r slog.Record) error {
+	if r.Message == "closed" {
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == "bytes_down" {
+				h.down <- a.Value.Int64()
+			}
+			return true
+		})
+	}
+	return nil
+}
+
+func (h *closedLog) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *closedLog) WithGroup(string) slog.Handler      { return h }
+
+func TestShutdownCountsRelayedBytes(t *testing.T) {
+	logs := &closedLog{Handler: slog.NewTextHandler(io.Discard, nil), down: make(chan int64, 1)}
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(logs))
+
+	be, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	go func() {
+		c, err := be.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write(make([]byte, 64))
+		io.Copy(io.Discard, c)
+	}()
+
+	cfg := GetDefaultConf()
+	cfg.FinalHTTP = be.Addr().String()
+	if err := cfg.Build(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Options{Mode: ModePlain, Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if _, err := io.ReadFull(c, make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+	// Cut the connection while the backend keeps it open
+	s.Shutdown(0)
+	select {
+	case down := <-logs.down:
+		if down != 64 {
+			t.Errorf("bytes_down = %d, want 64", down)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("connection not closed")
+	}
+}
+
+// emfileListener fails its first accepts as if out of file descriptors
+type emfileListener struct {
+	net.Listener
+	fails int
+}
+
+func (l *emfileListener) Accept() (net.Conn, error) {
+	if l.fails > 0 {
+		l.fails--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServeRetriesTemporaryErrors(t *testing.T) {
+	cfg := GetDefaultConf()
+	if err := cfg.Build(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Options{Mode: ModePlain, Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(&emfileListener{Listener: ln, fails: 3}) }()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("GARBAGE\r\n\r\n"))
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.Copy(io.Discard, c); err != nil {
+		t.Fatalf("connection not handled: %v", err)
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("Serve returned %v", err)
+	default:
+	}
+	s.Shutdown(0)
+	if err := <-served; err != nil {
+		t.Errorf("Serve returned %v after Shutdown", err)
+	}
+}
@@ -0,0 +1,139 @@
+package router
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP: %s", s)
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return nil
+}
+
+// connLimiter enforces the client limits of a listener mode
+type connLimiter struct {
+	mu     sync.Mutex
+	total  int
+	perIP  map[string]int
+	tokens float64
+	last   time.Time
+}
+
+// modeLimiters are shared by the servers of a mode, whatever their
+// addresses and across reloads
+var (
+	modeLimitersMu sync.Mutex
+	modeLimiters   = make(map[ListenMode]*connLimiter)
+)
+
+func limiterFor(mode ListenMode) *connLimiter {
+	modeLimitersMu.Lock()
+	defer modeLimitersMu.Unlock()
+	if modeLimiters[mode] == nil {
+		modeLimiters[mode] = &connLimiter{}
+	}
+	return modeLimiters[mode]
+}
+
+// allowAccept takes a token off the accept rate bucket
+func (l *connLimiter) allowAccept(lc *ListenerConfig) bool {
+	if lc.AcceptRate <= 0 {
+		return true
+	}
+	burst := float64(lc.AcceptBurst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(lc.AcceptRate))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else {
+		l.tokens = math.Min(burst, l.tokens+now.Sub(l.last).Seconds()*lc.AcceptRate)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// admit checks a client against the allow/deny lists and takes a slot
+// for it. The slot must be released unless a reason to reject is returned.
+func (l *connLimiter) admit(lc *ListenerConfig, addr net.Addr) string {
+	ip := addrIP(addr)
+	if ip != nil {
+		if containsIP(lc.clientDeny, ip) {
+			return "client denied"
+		}
+		if len(lc.clientAllow) > 0 && !containsIP(lc.clientAllow, ip) {
+			return "client not allowed"
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lc.MaxConns > 0 && l.total >= lc.MaxConns {
+		return "too many connections"
+	}
+	key := ip.String()
+	if lc.MaxConnsPerIP > 0 && ip != nil && l.perIP[key] >= lc.MaxConnsPerIP {
+		return "too many connections from client"
+	}
+	if l.perIP == nil {
+		l.perIP = make(map[string]int)
+	}
+	l.total++
+	l.perIP[key]++
+	return ""
+}
+
+func (l *connLimiter) release(addr net.Addr) {
+	key := addrIP(addr).String()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perIP[key]--; l.perIP[key] <= 0 {
+		delete(l.perIP, key)
+	}
+}
@@ -0,0 +1,43 @@
+package router
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logLevel is shared by the handlers so that a reload can change it
+var logLevel = new(slog.LevelVar)
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if level == "" {
+		return slog.LevelInfo, nil
+	}
+	err := l.UnmarshalText([]byte(level))
+	return l, err
+}
+
+func checkLogFormat(format string) error {
+	switch strings.ToLower(format) {
+	case "", "text", "json":
+		return nil
+	}
+	return fmt.Errorf("unknown log format: %s", format)
+}
+
+// SetupLogging makes slog, and the log package through it, write to stderr
+// in the configured level and format
+func SetupLogging(cfg *Config) {
+	level, _ := parseLogLevel(cfg.LogLevel)
+	logLevel.Set(level)
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var h slog.Handler
+	if strings.ToLower(cfg.LogFormat) == "json" {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(h))
+}
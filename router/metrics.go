@@ -0,0 +1,104 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Labels: listener is the listen mode, proto the sniffed protocol
+// (tls/http/h2c/socks4/socks5/ws, unknown before sniffing) and class the kind
+// of destination: final, redirect or tunnel.
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	connsAccepted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "quipu_router",
+		Name:      "connections_accepted_total",
+		Help:      "Connections whose first request was untied.",
+	}, []string{"listener", "proto"})
+	connsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "quipu_router",
+		Name:      "connections_rejected_total",
+		Help:      "Connections refused by limits or filters.",
+	}, []string{"listener", "proto", "reason"})
+	connsActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "quipu_router",
+		Name:      "connections_active",
+		Help:      "Connections being handled.",
+	}, []string{"listener"})
+	untieFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "quipu_router",
+		Name:      "untie_failures_total",
+		Help:      "Connections dropped before their first request was untied.",
+	}, []string{"listener", "stage", "error"})
+	routed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "quipu_router",
+		Name:      "routed_total",
+		Help:      "Connections relayed to a final backend or redirected to the next hop.",
+	}, []string{"listener", "proto", "class"})
+	dialDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "quipu_router",
+		Name:      "dial_duration_seconds",
+		Help:      "Time to resolve and connect the destination.",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"class"})
+	dialErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "quipu_router",
+		Name:      "dial_errors_total",
+		Help:      "Failures to resolve or connect the destination.",
+	}, []string{"class", "error"})
+	relayedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "quipu_router",
+		Name:      "relayed_bytes_total",
+		Help:      "Bytes relayed, upstream from clients and downstream to them.",
+	}, []string{"listener", "direction"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		connsAccepted, connsRejected, connsActive, untieFailures,
+		routed, dialDuration, dialErrors, relayedBytes,
+	)
+}
+
+// errorType names the kind of err for metric labels
+func errorType(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, errHandshakeTimeout), errors.Is(err, errDialTimeout):
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, net.ErrClosed):
+		return "closed"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return "network"
+	}
+	return "malformed"
+}
+
+// MetricsHandler serves the router metrics in the Prometheus format
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// NewMetricsServer returns a server for the metrics at /metrics
+func NewMetricsServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	return &http.Server{Handler: mux}
+}
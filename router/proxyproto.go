@@ -0,0 +1,242 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol, see https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+
+const (
+	proxyV1 = "v1"
+	proxyV2 = "v2"
+
+	proxyV1MaxLen = 107
+	proxyV2MaxLen = 4096
+)
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+func checkProxyVersion(v string) error {
+	switch v {
+	case "", "none", proxyV1, proxyV2:
+		return nil
+	}
+	return fmt.Errorf("unknown PROXY protocol version: %s", v)
+}
+
+// proxyRule picks the PROXY protocol version announced to some redirect
+// destinations. The rule format is
+//
+//	<v1|v2|none> <target> [ports]
+//
+// where target and ports are as in aclRule and a destination matches as in
+// upstreamRule. The first matching rule decides, then redir_proxy_protocol.
+type proxyRule struct {
+	*aclRule
+	version string
+}
+
+func parseProxyRule(rule string) (*proxyRule, error) {
+	fields := strings.Fields(rule)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid redir proxy rule: %s", rule)
+	}
+	version := strings.ToLower(fields[0])
+	if err := checkProxyVersion(version); err != nil {
+		return nil, err
+	}
+	r, err := parseACLRule("allow " + strings.Join(fields[1:], " "))
+	if err != nil {
+		return nil, err
+	}
+	return &proxyRule{aclRule: r, version: version}, nil
+}
+
+func (c *Config) BuildRedirProxyRules() error {
+	c.redirProxy = nil
+	return c.addRedirProxyRules(strings.Split(c.RedirProxyRules, ";"))
+}
+
+func (c *Config) addRedirProxyRules(rules []string) error {
+	for _, rule := range rules {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		r, err := parseProxyRule(rule)
+		if err != nil {
+			return err
+		}
+		c.redirProxy = append(c.redirProxy, r)
+	}
+	return nil
+}
+
+// RedirProxyVersion returns the PROXY protocol version to announce clients
+// to host, which resolved to ips, on port with
+func (c *Config) RedirProxyVersion(host string, ips []net.IP, port uint16) string {
+	domain := destDomain(host)
+	for _, r := range c.redirProxy {
+		if r.match(domain, ips, port, false) {
+			return r.version
+		}
+	}
+	return c.RedirProxyProtocol
+}
+
+// proxiedConn reports the client address carried by a PROXY header
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header. It returns the
+// source address of the header, or nil for LOCAL and UNKNOWN connections.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(len(proxyV2Sig))
+	if bytes.Equal(b, proxyV2Sig) {
+		return readProxyV2Header(r)
+	}
+	if bytes.HasPrefix(b, []byte("PROXY ")) {
+		return readProxyV1Header(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("missing PROXY protocol header")
+}
+
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, fmt.Errorf("PROXY v1 header is too long")
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 header")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unknown PROXY v2 version %d", hdr[12]>>4)
+	}
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+	if length > proxyV2MaxLen {
+		return nil, fmt.Errorf("PROXY v2 header is too long")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if hdr[12]&0x0f == 0 {
+		// LOCAL, e.g. health checks of the load balancer
+		return nil, nil
+	}
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("malformed PROXY v2 header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("malformed PROXY v2 header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
+
+// writeProxyHeader announces the connection from src to dst to the peer
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	var buf []byte
+	switch version {
+	case proxyV1:
+		buf = appendProxyV1Header(nil, src, dst)
+	case proxyV2:
+		buf = appendProxyV2Header(nil, src, dst)
+	default:
+		return nil
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// proxyAddrs returns the TCP addresses of a connection and whether both
+// are IPv4. Mixed families are announced as IPv6 with IPv4-mapped addresses.
+func proxyAddrs(src, dst net.Addr) (s *net.TCPAddr, d *net.TCPAddr, v4 bool, ok bool) {
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return nil, nil, false, false
+	}
+	return s, d, s.IP.To4() != nil && d.IP.To4() != nil, true
+}
+
+func proxyV6String(ip net.IP) string {
+	if ip.To4() != nil {
+		return "::ffff:" + ip.String()
+	}
+	return ip.String()
+}
+
+func appendProxyV1Header(buf []byte, src, dst net.Addr) []byte {
+	s, d, v4, ok := proxyAddrs(src, dst)
+	if !ok {
+		return append(buf, "PROXY UNKNOWN\r\n"...)
+	}
+	if v4 {
+		return fmt.Appendf(buf, "PROXY TCP4 %s %s %d %d\r\n", s.IP, d.IP, s.Port, d.Port)
+	}
+	return fmt.Appendf(buf, "PROXY TCP6 %s %s %d %d\r\n",
+		proxyV6String(s.IP), proxyV6String(d.IP), s.Port, d.Port)
+}
+
+func appendProxyV2Header(buf []byte, src, dst net.Addr) []byte {
+	buf = append(buf, proxyV2Sig...)
+	s, d, v4, ok := proxyAddrs(src, dst)
+	if !ok {
+		// LOCAL with no address
+		return append(buf, 0x20, 0x00, 0x00, 0x00)
+	}
+	if v4 {
+		buf = append(buf, 0x21, 0x11, 0x00, 12)
+		buf = append(append(buf, s.IP.To4()...), d.IP.To4()...)
+	} else {
+		buf = append(buf, 0x21, 0x21, 0x00, 36)
+		buf = append(append(buf, s.IP.To16()...), d.IP.To16()...)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(s.Port))
+	return binary.BigEndian.AppendUint16(buf, uint16(d.Port))
+}
@@ -0,0 +1,100 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	unix := &net.UnixAddr{Name: "/run/quipu.sock", Net: "unix"}
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+		want     *net.TCPAddr // nil for LOCAL and UNKNOWN
+	}{
+		{"tcp4", v4, &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 80}, v4},
+		{"tcp6", v6, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80}, v6},
+		{"v4 to v6", v4, v6, v4},
+		{"v6 to v4", v6, v4, v6},
+		{"unix", unix, v4, nil},
+	}
+	for _, version := range []string{proxyV1, proxyV2} {
+		for _, tt := range tests {
+			t.Run(version+" "+tt.name, func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := writeProxyHeader(&buf, version, tt.src, tt.dst); err != nil {
+					t.Fatal(err)
+				}
+				buf.WriteString("payload")
+				r := bufio.NewReader(&buf)
+				got, err := readProxyHeader(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.want == nil {
+					if got != nil {
+						t.Errorf("source %v, want none", got)
+					}
+				} else if a, ok := got.(*net.TCPAddr); !ok || !a.IP.Equal(tt.want.IP) || a.Port != tt.want.Port {
+					t.Errorf("source %v, want %v", got, tt.want)
+				}
+				if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+					t.Errorf("read past the header, left %q", rest)
+				}
+			})
+		}
+	}
+}
+
+// proxyV2Header is a v2 header of command, family and body
+func proxyV2Header(command, family byte, length int, body []byte) string {
+	hdr := append(append([]byte{}, proxyV2Sig...), command, family)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(length))
+	return string(append(hdr, body...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for name, input := range map[string]string{
+		"v1 unknown":        "PROXY UNKNOWN\r\n",
+		"v1 unknown fields": "PROXY UNKNOWN 192.0.2.1 192.0.2.2 1 2\r\n",
+		"v2 local":          proxyV2Header(0x20, 0x11, 12, make([]byte, 12)),
+		"v2 unspec":         proxyV2Header(0x21, 0x00, 0, nil),
+		"v2 unix":           proxyV2Header(0x21, 0x31, 216, make([]byte, 216)),
+		"v2 tlvs":           proxyV2Header(0x21, 0x00, 5, []byte{0x04, 0x00, 0x02, 'h', 'i'}),
+	} {
+		src, err := readProxyHeader(bufio.NewReader(strings.NewReader(input)))
+		if err != nil || src != nil {
+			t.Errorf("%s: source %v, %v, want none", name, src, err)
+		}
+	}
+}
+
+func TestReadProxyHeaderMalformed(t *testing.T) {
+	for name, input := range map[string]string{
+		"none":              "GET / HTTP/1.1\r\n\r\n",
+		"empty":             "",
+		"v1 truncated":      "PROXY TCP4 192.0.2.1",
+		"v1 few fields":     "PROXY TCP4 192.0.2.1 192.0.2.2 1\r\n",
+		"v1 bad family":     "PROXY TCP5 192.0.2.1 192.0.2.2 1 2\r\n",
+		"v1 bad ip":         "PROXY TCP4 192.0.2.x 192.0.2.2 1 2\r\n",
+		"v1 bad port":       "PROXY TCP4 192.0.2.1 192.0.2.2 65536 2\r\n",
+		"v1 oversized":      "PROXY TCP6 " + strings.Repeat("1", 200) + "\r\n",
+		"v2 version":        strings.Replace(proxyV2Header(0x21, 0x11, 12, make([]byte, 12)), "\x21", "\x11", 1),
+		"v2 oversized":      proxyV2Header(0x21, 0x11, proxyV2MaxLen+1, make([]byte, proxyV2MaxLen+1)),
+		"v2 truncated":      proxyV2Header(0x21, 0x11, 12, make([]byte, 4)),
+		"v2 truncated head": proxyV2Header(0x21, 0x11, 12, nil)[:14],
+		"v2 short inet":     proxyV2Header(0x21, 0x11, 4, make([]byte, 4)),
+		"v2 short inet6":    proxyV2Header(0x21, 0x21, 12, make([]byte, 12)),
+	} {
+		if src, err := readProxyHeader(bufio.NewReader(strings.NewReader(input))); err == nil {
+			t.Errorf("%s: source %v, want an error", name, src)
+		}
+	}
+}
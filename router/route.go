@@ -0,0 +1,126 @@
+package router
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Max-Sum/quipu/knotchain"
+)
+
+// finalRoute picks a final backend by stem hostname, protocol and ALPN.
+// The rule format is whitespace separated key=value pairs, e.g.
+//
+//	host=*.example.com proto=tls alpn=h2,http/1.1 backend=127.0.0.1:8443 proxy=v2
+//
+// host, proto and alpn take comma separated lists and may be omitted.
+// A host of *.example.com matches subdomains of example.com only.
+// proxy overrides final_proxy_protocol for the backend.
+type finalRoute struct {
+	hosts   []string
+	protos  []string
+	alpns   []string
+	backend string
+	proxy   string
+}
+
+func parseFinalRoute(rule string) (*finalRoute, error) {
+	r := &finalRoute{}
+	for _, field := range strings.Fields(rule) {
+		k, v, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid route field: %s", field)
+		}
+		values := strings.Split(strings.ToLower(v), ",")
+		switch strings.ToLower(k) {
+		case "host":
+			r.hosts = values
+		case "proto":
+			r.protos = values
+		case "alpn":
+			r.alpns = values
+		case "backend":
+			r.backend = v
+		case "proxy":
+			if err := checkProxyVersion(v); err != nil {
+				return nil, err
+			}
+			r.proxy = v
+		default:
+			return nil, fmt.Errorf("unknown route field: %s", k)
+		}
+	}
+	if r.backend == "" {
+		return nil, fmt.Errorf("route without backend: %s", rule)
+	}
+	return r, nil
+}
+
+func (r *finalRoute) match(u *Untied) bool {
+	if len(r.protos) > 0 && !slices.Contains(r.protos, u.Proto) {
+		return false
+	}
+	if len(r.alpns) > 0 && !slices.ContainsFunc(u.ALPN, func(p string) bool {
+		return slices.Contains(r.alpns, p)
+	}) {
+		return false
+	}
+	if len(r.hosts) == 0 {
+		return true
+	}
+	stem, _ := knotchain.StemHostname(strings.ToLower(u.Hostname))
+	for _, h := range r.hosts {
+		if h == "*" || h == stem {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(h, "*"); ok && strings.HasSuffix(stem, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) BuildRoutes() error {
+	c.routes = nil
+	return c.addRoutes(strings.Split(c.RouteRules, ";"))
+}
+
+func (c *Config) addRoutes(rules []string) error {
+	for _, rule := range rules {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		r, err := parseFinalRoute(rule)
+		if err != nil {
+			return err
+		}
+		c.routes = append(c.routes, r)
+	}
+	return nil
+}
+
+// FinalBackend returns the backend for a connection at the end of its
+// chain and the PROXY protocol version to announce the client with. The
+// first matching route wins, then the per-protocol default.
+func (c *Config) FinalBackend(u *Untied) (string, string) {
+	for _, r := range c.routes {
+		if !r.match(u) {
+			continue
+		}
+		if r.proxy != "" {
+			return r.backend, r.proxy
+		}
+		return r.backend, c.FinalProxyProtocol
+	}
+	switch u.Proto {
+	case "tls":
+		return c.FinalTLS, c.FinalProxyProtocol
+	case "http", "h2c":
+		return c.FinalHTTP, c.FinalProxyProtocol
+	case "socks4", "socks5":
+		return c.FinalSocks, c.FinalProxyProtocol
+	case "ws":
+		return c.FinalWS, c.FinalProxyProtocol
+	}
+	return "", ""
+}
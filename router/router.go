@@ -4,126 +4,417 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/Max-Sum/quipu/knotchain"
 	"github.com/ginuerzh/gosocks4"
 	"github.com/ginuerzh/gosocks5"
 	dissector "github.com/go-gost/tls-dissector"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-var bufferPool = sync.Pool{
-	New: func() interface{} {
-		return make([]byte, 32*1024)
-	},
+const (
+	handshakeHeaderLen = 4
+	maxRecordLen       = 1 << 14
+	maxClientHelloLen  = 1 << 16
+)
+
+// ListenMode decides how a listener sniffs the first bytes of a connection.
+type ListenMode int
+
+const (
+	ModePlain     ListenMode = iota // HTTP, h2c and SOCKS
+	ModeTLS                         // TLS ClientHello
+	ModeMux                         // TLS or plain, told apart by the first byte
+	ModeTunnel                      // mux over streams of tunnels from peer routers
+	ModeWebSocket                   // byte streams over WebSocket upgrades
+)
+
+func (m ListenMode) String() string {
+	switch m {
+	case ModePlain:
+		return "plain"
+	case ModeTLS:
+		return "tls"
+	case ModeMux:
+		return "mux"
+	case ModeTunnel:
+		return "tunnel"
+	case ModeWebSocket:
+		return "ws"
+	}
+	return "unknown"
 }
 
 type TCPServer struct {
 	listen string
-	isTLS  bool
-	cfg    *routerConf
+	mode   ListenMode
+	cfg    atomic.Pointer[Config]
 	ctx    context.Context
 	cancel context.CancelFunc
 	mu     sync.Mutex
-	conns  map[*net.Conn]struct{}
+	conns  map[net.Conn]*connInfo
 	ln     net.Listener
+	closed bool          // no longer accepting
+	drain  chan struct{} // closed by Shutdown
+
+	hooks    Hooks
+	limiter  *connLimiter
+	rejected atomic.Uint64
 }
 
-func NewTCPServer(listen string, isTLS bool, cfg *routerConf) *TCPServer {
-	return &TCPServer{
-		listen: listen,
-		isTLS:  isTLS,
-		cfg:    cfg,
-		conns:  make(map[*net.Conn]struct{}),
+func NewTCPServer(listen string, mode ListenMode, cfg *Config) *TCPServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &TCPServer{
+		listen:  listen,
+		mode:    mode,
+		ctx:     ctx,
+		cancel:  cancel,
+		conns:   make(map[net.Conn]*connInfo),
+		drain:   make(chan struct{}),
+		limiter: limiterFor(mode),
 	}
+	s.cfg.Store(cfg)
+	return s
 }
 
-func (s *TCPServer) ListenAndServe() (err error) {
-	s.ctx, s.cancel = context.WithCancel(context.Background())
-	s.ln, err = net.Listen("tcp", s.listen)
-	log.Printf("listening on %s\n", s.listen)
+func (s *TCPServer) conf() *Config {
+	return s.cfg.Load()
+}
+
+// SetConf swaps the config of new connections, the existing ones keep
+// the config they started with. The listen address is not changed.
+func (s *TCPServer) SetConf(cfg *Config) {
+	s.cfg.Store(cfg)
+}
+
+// ListenAndServe listens on the address:port or unix socket path of the
+// server and serves it
+func (s *TCPServer) ListenAndServe() error {
+	ln, err := Listen(s.listen)
 	if err != nil {
-		s.cancel()
 		return err
 	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln until Shutdown, after which it returns
+// nil. Temporary accept errors, like running out of file descriptors, are
+// retried with a backoff. ln is closed on return.
+func (s *TCPServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	if s.mode == ModeTunnel && s.conf().TunnelSecret == "" {
+		// Anyone could pass for a peer and be trusted with PROXY headers
+		s.mu.Unlock()
+		ln.Close()
+		return errNoTunnelSecret
+	}
+	s.ln = ln
+	if s.listen == "" {
+		s.listen = ln.Addr().String()
+	}
+	s.mu.Unlock()
+	defer ln.Close()
+	slog.Info("listening", "listener", s.mode.String(), "addr", ln.Addr().String())
+	var backoff time.Duration
 	for {
-		conn, err := s.ln.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
-			s.cancel()
-			return err
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			if !temporaryAcceptErr(err) {
+				return err
+			}
+			backoff = min(max(2*backoff, acceptBackoffMin), acceptBackoffMax)
+			slog.Warn("failed to accept, retrying", "listener", s.mode.String(), "err", err, "backoff", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-s.drain:
+			}
+			continue
+		}
+		backoff = 0
+		if s.mode == ModeTunnel {
+			go s.serveTunnel(conn)
+			continue
+		}
+		if !s.limiter.allowAccept(s.conf().ListenerConf(s.mode)) {
+			s.reject(slog.With("listener", s.mode.String(), "client", conn.RemoteAddr().String()),
+				"unknown", "accept rate exceeded")
+			conn.Close()
+			continue
 		}
 		go s.Handle(conn)
 	}
 }
 
-func (s *TCPServer) Shutdown() {
-	s.ln.Close()
-	for c := range s.conns {
-		(*c).Close()
+// Bounds of the backoff on temporary accept errors
+const (
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
+)
+
+// temporaryAcceptErr tells whether accepting may succeed again later
+func temporaryAcceptErr(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *TCPServer) reject(logger *slog.Logger, proto, reason string) {
+	connsRejected.WithLabelValues(s.mode.String(), proto, reason).Inc()
+	n := s.rejected.Add(1)
+	logger.Info("rejected", "reason", reason, "rejected_total", n)
+}
+
+// fail ends a connection that failed to untie at stage, or to reach its
+// destination class, counting the failure, recording the close reason and
+// logging "failed to <action>"
+func (s *TCPServer) fail(info *connInfo, logger *slog.Logger, stage, action string, err error) {
+	switch stage {
+	case "final", "redirect", "tunnel":
+		err = timeoutErr(err, errDialTimeout)
+		dialErrors.WithLabelValues(stage, errorType(err)).Inc()
+		info.closing("dial_failed", err)
+		logger.Warn("failed to "+action, "err", err)
+	default:
+		err = timeoutErr(err, errHandshakeTimeout)
+		untieFailures.WithLabelValues(s.mode.String(), stage, errorType(err)).Inc()
+		info.closing("handshake_failed", err)
+		logger.Info("failed to "+action, "err", err)
+	}
+}
+
+// rejectConn rejects a connection being handled
+func (s *TCPServer) rejectConn(info *connInfo, logger *slog.Logger, proto, reason string) {
+	info.closing("rejected", errors.New(reason))
+	s.reject(logger, proto, reason)
+}
+
+// StopListening stops accepting and frees the listen address, leaving the
+// connections to Shutdown
+func (s *TCPServer) StopListening() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		close(s.drain)
+	}
+	s.closed = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+}
+
+// Shutdown stops accepting and waits up to grace for the connections to
+// finish, then closes the remaining ones. It returns how many were cut.
+func (s *TCPServer) Shutdown(grace time.Duration) int {
+	s.StopListening()
+
+	deadline := time.Now().Add(grace)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for s.activeConns() > 0 && time.Now().Before(deadline) {
+		<-ticker.C
+	}
+
+	s.mu.Lock()
+	cut := len(s.conns)
+	for c, info := range s.conns {
+		info.closing("shutdown", nil)
+		c.Close()
+	}
+	s.mu.Unlock()
+	// Give the cut handlers a moment to write their audit records
+	for deadline = time.Now().Add(time.Second); s.activeConns() > 0 && time.Now().Before(deadline); {
+		<-ticker.C
 	}
 	s.cancel()
+	slog.Info("listener closed", "listener", s.mode.String(), "addr", s.listen, "cut", cut)
+	return cut
+}
+
+func (s *TCPServer) activeConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
 }
 
 func (s *TCPServer) Handle(conn net.Conn) {
-	s.trackConn(&conn, true)
+	info := s.addConn(conn)
+	if info == nil {
+		conn.Close()
+		return
+	}
+	defer func(c net.Conn) {
+		s.removeConn(c)
+		c.Close()
+	}(conn)
+	var relayErr error
 	defer func() {
-		if conn != nil {
-			s.trackConn(&conn, false)
-			conn.Close()
+		status := info.status(s.mode.String())
+		if s.hooks != nil {
+			s.hooks.Closed(status, relayErr)
 		}
+		info.closing(closeReason(relayErr), relayErr)
+		reason, err := info.closeReason()
+		audit(status, reason, err)
 	}()
+	defer func() {
+		// A sniffer or hook choking on a malformed request must not take
+		// the router down
+		if p := recover(); p != nil {
+			err := fmt.Errorf("panic: %v", p)
+			untieFailures.WithLabelValues(s.mode.String(), "panic", errorType(err)).Inc()
+			info.closing("handshake_failed", err)
+			slog.Error("recovered from panic", "conn", info.id, "listener", s.mode.String(),
+				"client", conn.RemoteAddr().String(), "err", err, "stack", string(debug.Stack()))
+		}
+	}()
+	cfg := s.conf()
 	br := bufio.NewReader(conn)
+	logger := slog.With("conn", info.id, "listener", s.mode.String(),
+		"client", conn.RemoteAddr().String(), "local", conn.LocalAddr().String())
+	logger.Debug("accepted")
+
+	// Bound everything up to the first request
+	if cfg.HandshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(cfg.HandshakeTimeout))
+	}
+	lc := cfg.ListenerConf(s.mode)
+	if lc.AcceptProxy || s.mode == ModeTunnel {
+		src, err := readProxyHeader(br)
+		if err != nil {
+			s.fail(info, logger, "proxy_header", "read PROXY header", err)
+			return
+		}
+		if src != nil {
+			conn = &proxiedConn{Conn: conn, remote: src}
+			logger = logger.With("origin", src.String())
+			info.mu.Lock()
+			info.client = src.String()
+			info.mu.Unlock()
+		}
+	}
+	client := conn.RemoteAddr()
+	if reason := s.limiter.admit(lc, client); reason != "" {
+		s.rejectConn(info, logger, "unknown", reason)
+		return
+	}
+	defer s.limiter.release(client)
+	if s.hooks != nil {
+		if err := s.hooks.Accepted(s.ctx, conn); err != nil {
+			s.rejectConn(info, logger.With("err", err), "unknown", "rejected by hook")
+			return
+		}
+	}
 
-	var readahead []byte
-	var nextKnot knotchain.Knot
-	proto := ""
+	var u *Untied
 	var err error
-	if !s.isTLS {
-		// We assume it is an HTTP request
-		// HTTP/Socks sniff
-		readahead, proto, nextKnot, err = s.untieTCPHost(br)
+	if s.mode == ModeWebSocket {
+		var ws *wsConn
+		if u, ws, err = s.untieWebSocket(conn, br); ws != nil {
+			conn, br = ws, bufio.NewReader(ws)
+		}
 	} else {
-		// TLS sniff
-		proto = "tls"
-		readahead, nextKnot, err = s.untieClientHelloRecord(br)
+		sniffers := lc.sniffers
+		if sniffers == nil {
+			sniffers = modeSniffers(s.mode)
+		}
+		var sn Sniffer
+		if sn, err = sniff(sniffers, br); err != nil {
+			s.fail(info, logger, "sniff", "sniff", err)
+			return
+		}
+		u, err = sn.Untie(s, br)
 	}
 	if err == knotchain.ErrNoKnotToUntie {
 		err = nil
-		nextKnot = nil
+		u.NextKnot = nil
 	} else if err != nil {
-		log.Printf("[handle] Failed to untie %s -> %s : %s",
-			conn.RemoteAddr(), conn.LocalAddr(), err)
+		s.fail(info, logger, "untie", "untie", err)
 		return
 	}
+	if tlsConf := cfg.terminateConfig(u.OrigHost); u.Proto == "tls" && u.NextKnot == nil && tlsConf != nil {
+		// The chain ends at our own stem, open the stream and untie what it carries
+		tconn := tls.Server(&wrappedConn{br: br, Conn: conn, prepend: u.Readahead}, tlsConf)
+		if err := tconn.Handshake(); err != nil {
+			s.fail(info, logger, "tls_handshake", "terminate TLS", err)
+			return
+		}
+		conn, br = tconn, bufio.NewReader(tconn)
+		logger = logger.With("tls", "terminated", "sni", u.OrigHost)
+		u, err = s.untieTCPHost(br)
+		if err == knotchain.ErrNoKnotToUntie {
+			err = nil
+			u.NextKnot = nil
+		} else if err != nil {
+			s.fail(info, logger, "untie", "untie", err)
+			return
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	connsAccepted.WithLabelValues(s.mode.String(), u.Proto).Inc()
+	logger = logger.With("proto", u.Proto, "host", u.Hostname)
+	info.mu.Lock()
+	info.proto, info.origHost, info.hostname = u.Proto, u.OrigHost, u.Hostname
+	if u.NextKnot != nil {
+		info.knot = knotchain.KnotString(u.NextKnot)
+	}
+	info.mu.Unlock()
 
-	wconn := &wrappedConn{br: br, Conn: conn, prepend: readahead}
+	wconn := &wrappedConn{br: br, Conn: conn, prepend: u.Readahead}
+	nextKnot := u.NextKnot
+	up, down, start := info.up, info.down, time.Now()
+	route := &Route{Listener: s.mode.String(), Client: conn.RemoteAddr(), Proto: u.Proto,
+		OrigHost: u.OrigHost, Hostname: u.Hostname, Knot: info.knot}
+	if s.hooks != nil {
+		if err := s.hooks.Untied(s.ctx, route); err != nil {
+			s.rejectConn(info, logger.With("err", err), u.Proto, "rejected by hook")
+			return
+		}
+		if route.Backend != "" {
+			nextKnot = nil
+		}
+	}
 
 	if nextKnot == nil {
 		// Reached end of chain
-		network := ""
-		address := ""
-		switch proto {
-		case "tls":
-			network = "tcp"
-			address = s.cfg.FinalTLS
-		case "http":
-			network = "tcp"
-			address = s.cfg.FinalHTTP
-		case "socks4":
-			fallthrough
-		case "socks5":
-			network = "tcp"
-			address = s.cfg.FinalSocks
+		network := "tcp"
+		address, proxyVersion := cfg.FinalBackend(u)
+		if route.Backend != "" {
+			address = route.Backend
 		}
 		if len(address) == 0 {
-			log.Printf("[handle] No final backend for proto[%s] (%s -> %s)",
-				proto, conn.RemoteAddr(), conn.LocalAddr())
+			s.rejectConn(info, logger, u.Proto, "no final backend")
 			return
 		}
 		if !strings.Contains(address, ":") {
@@ -134,17 +425,36 @@ func (s *TCPServer) Handle(conn net.Conn) {
 				network = "unix"
 			}
 		}
-		log.Printf("Final: %s -> %s", conn.RemoteAddr(), address)
-		dialer := net.Dialer{}
-		rconn, err := dialer.DialContext(s.ctx, network, address)
+		logger = logger.With("route", "final", "dest", address)
+		info.mu.Lock()
+		info.backend = address
+		info.mu.Unlock()
+		logger.Debug("routing")
+		routed.WithLabelValues(s.mode.String(), u.Proto, "final").Inc()
+		ctx, cancel := s.dialContext()
+		dialStart := time.Now()
+		var rconn net.Conn
+		route.Backend = address
+		if s.hooks != nil {
+			rconn, err = s.hooks.Dial(ctx, route)
+		}
+		if rconn == nil && err == nil {
+			if upstream := cfg.upstreamFor(address); network == "tcp" && upstream != nil {
+				logger = logger.With("upstream", upstream.Redacted())
+				rconn, err = dialUpstream(ctx, upstream, address)
+			} else {
+				dialer := net.Dialer{}
+				rconn, err = dialer.DialContext(ctx, network, address)
+			}
+		}
+		cancel()
 		if err != nil {
-			log.Printf("[handle] Failed to relay %s -> %s -> %s : %s",
-				conn.RemoteAddr(), conn.LocalAddr(), address, err)
+			s.fail(info, logger, "final", "dial", err)
 			return
 		}
+		dialDuration.WithLabelValues("final").Observe(time.Since(dialStart).Seconds())
 		if rconn == nil {
-			log.Printf("[handle] Failed to relay %s -> %s -> %s : rconn is nil",
-				conn.RemoteAddr(), conn.LocalAddr(), address)
+			s.fail(info, logger, "final", "dial", errors.New("rconn is nil"))
 			return
 		}
 		defer func() {
@@ -152,116 +462,245 @@ func (s *TCPServer) Handle(conn net.Conn) {
 				rconn.Close()
 			}
 		}()
-		transport(wconn, rconn)
+		if err := writeProxyHeader(rconn, proxyVersion, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+			s.fail(info, logger, "final", "send PROXY header", err)
+			return
+		}
+		defer s.shape(cfg, logger, conn.RemoteAddr(), "final", up, down)()
+		relayErr = transport(wconn, rconn, cfg.IdleTimeout, up, down)
+		s.logClosed(logger, relayErr, up, down, start)
 		return
 	}
 
-	if !s.cfg.EnableRedir {
+	logger = logger.With("route", "redirect", "knot", knotchain.KnotString(nextKnot))
+	if !cfg.EnableRedir {
 		// no nextKnot and no routes matched, failing
-		log.Printf("[handle] redir is disabled %s -> %s -> %s",
-			conn.RemoteAddr(), conn.LocalAddr(), knotchain.KnotString(nextKnot))
+		s.rejectConn(info, logger, u.Proto, "redir disabled")
 		return
 	}
 
 	// Filter allow and deny
-	if !s.cfg.IsPortAllowed(nextKnot.Port()) {
-		log.Printf("[handle] Redir port not allowed %s -> %s -> %s",
-			conn.RemoteAddr(), conn.LocalAddr(), knotchain.KnotString(nextKnot))
+	if !cfg.IsPortAllowed(nextKnot.Port()) {
+		s.rejectConn(info, logger, u.Proto, "port not allowed")
 		return
 	}
 
-	log.Printf("Redirect: %s -> %s:%d", conn.RemoteAddr(), nextKnot.Host(), nextKnot.Port())
-	rconn, err := nextKnot.DialContext(s.ctx, "tcp")
-	if err != nil {
-		log.Printf("[handle] Failed to relay %s -> %s -> %s : %s",
-			conn.RemoteAddr(), conn.LocalAddr(), knotchain.KnotString(nextKnot), err)
+	// Resolving counts towards the dial timeout
+	ctx, cancel := s.dialContext()
+	defer cancel()
+	dialStart := time.Now()
+	ips, err := resolveKnot(ctx, nextKnot)
+	// A resolving upstream is sent the name, so that routers without DNS
+	// of their own can redirect. The ACL checks the IPs only if resolved.
+	upstream := cfg.Upstream(nextKnot.Host(), ips, nextKnot.Port())
+	byName := knotIPs(nextKnot) == nil && resolvesNames(upstream)
+	if err != nil && !byName {
+		s.fail(info, logger, "redirect", "resolve", err)
+		return
+	}
+	if !cfg.IsDestAllowed(nextKnot.Host(), ips, nextKnot.Port()) {
+		s.rejectConn(info, logger.With("ips", ips), u.Proto, "destination not allowed")
 		return
 	}
 
+	logger.Debug("routing")
+	routed.WithLabelValues(s.mode.String(), u.Proto, "redirect").Inc()
+	// A tunnel stream announces the client in its own PROXY header
+	proxyVersion := cfg.RedirProxyVersion(nextKnot.Host(), ips, nextKnot.Port())
+	var rconn net.Conn
+	class := "redirect"
+	if s.hooks != nil {
+		if rconn, err = s.hooks.Dial(ctx, route); err != nil {
+			s.fail(info, logger, "redirect", "dial", err)
+			return
+		}
+	}
+	if addr, ok := cfg.TunnelPeer(nextKnot); ok && rconn == nil {
+		tunnelStart := time.Now()
+		rconn, err = getTunnelPool(addr, cfg.TunnelSecret, cfg.TunnelPoolSize).open(ctx)
+		if err != nil {
+			dialErrors.WithLabelValues("tunnel", errorType(err)).Inc()
+			logger.Warn("failed to open tunnel, dialing directly", "tunnel", addr, "err", err)
+		} else {
+			dialDuration.WithLabelValues("tunnel").Observe(time.Since(tunnelStart).Seconds())
+			proxyVersion = proxyV2
+			logger = logger.With("tunnel", addr)
+			class = "tunnel"
+		}
+	}
+	if rconn == nil {
+		if upstream != nil {
+			logger = logger.With("upstream", upstream.Redacted())
+		}
+		if byName {
+			rconn, err = dialUpstream(ctx, upstream, net.JoinHostPort(nextKnot.Host(), fmt.Sprint(nextKnot.Port())))
+		} else {
+			// Dial the checked addresses rather than resolving again
+			rconn, err = dialIPs(ctx, upstream, ips, nextKnot.Port())
+		}
+		if err != nil {
+			s.fail(info, logger, "redirect", "dial", err)
+			return
+		}
+		dialDuration.WithLabelValues("redirect").Observe(time.Since(dialStart).Seconds())
+	}
+	cancel()
+	logger = logger.With("dest", rconn.RemoteAddr().String())
+
 	defer func() {
 		if rconn != nil {
 			rconn.Close()
 		}
 	}()
-	transport(wconn, rconn)
+	if err := writeProxyHeader(rconn, proxyVersion, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+		s.fail(info, logger, class, "send PROXY header", err)
+		return
+	}
+	defer s.shape(cfg, logger, conn.RemoteAddr(), class, up, down)()
+	relayErr = transport(wconn, rconn, cfg.IdleTimeout, up, down)
+	s.logClosed(logger, relayErr, up, down, start)
+}
+
+// logClosed sums up a relayed connection
+func (s *TCPServer) logClosed(logger *slog.Logger, err error, up, down *relayCounter, start time.Time) {
+	attrs := []any{"bytes_up", up.n.Load(), "bytes_down", down.n.Load(), "duration", time.Since(start)}
+	if err != nil {
+		attrs = append(attrs, "err", err)
+	}
+	logger.Info("closed", attrs...)
 }
 
-func (s *TCPServer) trackConn(conn *net.Conn, add bool) {
+// connSeq numbers the connections of the process for the logs
+var connSeq atomic.Uint64
+
+// dialContext bounds resolving and dialing the next hop
+func (s *TCPServer) dialContext() (context.Context, context.CancelFunc) {
+	if s.conf().DialTimeout > 0 {
+		return context.WithTimeout(s.ctx, s.conf().DialTimeout)
+	}
+	return context.WithCancel(s.ctx)
+}
+
+// addConn tracks a new connection, refusing it after Shutdown
+func (s *TCPServer) addConn(conn net.Conn) *connInfo {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if add {
-		s.conns[conn] = struct{}{}
-	} else {
-		delete(s.conns, conn)
+	if s.closed {
+		return nil
+	}
+	info := &connInfo{
+		id:     connSeq.Add(1),
+		start:  time.Now(),
+		up:     s.relayCounter("upstream"),
+		down:   s.relayCounter("downstream"),
+		client: conn.RemoteAddr().String(),
 	}
+	s.conns[conn] = info
+	connsActive.WithLabelValues(s.mode.String()).Inc()
+	return info
+}
+
+func (s *TCPServer) removeConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+	connsActive.WithLabelValues(s.mode.String()).Dec()
 }
 
-func (s *TCPServer) untieTCPHost(r *bufio.Reader) (buf []byte, proto string, nextKnot knotchain.Knot, err error) {
-	b, err := r.Peek(1)
+// Untied is what the first request of a connection tells about its route
+type Untied struct {
+	Proto     string
+	OrigHost  string // as received, without port
+	Hostname  string // as passed on to the next hop, without port
+	ALPN      []string
+	Readahead []byte         // the rewritten request
+	NextKnot  knotchain.Knot // nil at the end of the chain
+}
+
+// untieTCPHost unties a plaintext stream like the plain listener does
+func (s *TCPServer) untieTCPHost(r *bufio.Reader) (*Untied, error) {
+	sn, err := sniff(modeSniffers(ModePlain), r)
 	if err != nil {
-		return nil, "", nil, err
+		return nil, err
 	}
+	return sn.Untie(s, r)
+}
 
-	switch b[0] {
-	case gosocks4.Ver4:
-		proto = "socks4"
-		buf, nextKnot, err = s.untieSocks4Host(r)
-	case gosocks5.Ver5: // socks5
-		proto = "socks5"
-		buf, nextKnot, err = s.untieSocks5Host(r)
-	default: // http
-		proto = "http"
-		buf, nextKnot, err = s.untieHTTPHost(r)
+// UntieHostname unties the next knot from a plaintext hostname. Once the
+// chain is exhausted, the stem hostname is restored if the stem asks for it.
+func (s *TCPServer) UntieHostname(hostname string) (knotchain.Knot, string, error) {
+	nextKnot, newHost, err := knotchain.UntieHostname(hostname)
+	if err == knotchain.ErrNoKnotToUntie {
+		if stem, ok := knotchain.StemHostname(newHost); ok && s.conf().StemConf(stem).RestoreHost {
+			newHost = stem
+		}
 	}
-	return
+	return nextKnot, newHost, err
 }
 
-func (s *TCPServer) untieSocks4Host(r *bufio.Reader) ([]byte, knotchain.Knot, error) {
+// UntieAuthority is UntieHostname for host[:port]
+func (s *TCPServer) UntieAuthority(authority string) (knotchain.Knot, string, error) {
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		host, port = authority, ""
+	}
+	nextKnot, newHost, err := s.UntieHostname(host)
+	if err != nil && err != knotchain.ErrNoKnotToUntie {
+		return nil, "", err
+	}
+	if port != "" {
+		newHost = net.JoinHostPort(newHost, port)
+	}
+	return nextKnot, newHost, err
+}
+
+func (s *TCPServer) untieSocks4Host(r *bufio.Reader) (*Untied, error) {
 	req, err := gosocks4.ReadRequest(r)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	var nextKnot knotchain.Knot
-	nextKnot, req.Addr.Host, err = knotchain.UntieHostname(req.Addr.Host)
+	u := &Untied{Proto: "socks4", OrigHost: req.Addr.Host}
+	u.NextKnot, req.Addr.Host, err = s.UntieHostname(req.Addr.Host)
 	if err != nil && err != knotchain.ErrNoKnotToUntie {
-		return nil, nil, err
+		return nil, err
 	}
+	u.Hostname = req.Addr.Host
 	// Prepend the read part
 	buf := &bytes.Buffer{}
 	req.Write(buf)
-	return buf.Bytes(), nextKnot, err
+	u.Readahead = buf.Bytes()
+	return u, err
 }
 
-func (s *TCPServer) untieSocks5Host(r *bufio.Reader) ([]byte, knotchain.Knot, error) {
+func (s *TCPServer) untieSocks5Host(r *bufio.Reader) (*Untied, error) {
 	req, err := gosocks5.ReadRequest(r)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	var nextKnot knotchain.Knot
-	nextKnot, req.Addr.Host, err = knotchain.UntieHostname(req.Addr.Host)
+	u := &Untied{Proto: "socks5", OrigHost: req.Addr.Host}
+	u.NextKnot, req.Addr.Host, err = s.UntieHostname(req.Addr.Host)
 	if err != nil && err != knotchain.ErrNoKnotToUntie {
-		return nil, nil, err
+		return nil, err
 	}
+	u.Hostname = req.Addr.Host
 	// Prepend the read part
 	buf := &bytes.Buffer{}
 	req.Write(buf)
-	return buf.Bytes(), nextKnot, err
+	u.Readahead = buf.Bytes()
+	return u, err
 }
 
-func (s *TCPServer) untieHTTPHost(r *bufio.Reader) ([]byte, knotchain.Knot, error) {
+func (s *TCPServer) untieHTTPHost(r *bufio.Reader) (*Untied, error) {
 	req, err := http.ReadRequest(r)
 	if err != nil {
-		return nil, nil, err
-	}
-	host, port, err := net.SplitHostPort(req.Host)
-	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	nextKnot, newHost, err := knotchain.UntieHostname(host)
+	u := &Untied{Proto: "http", OrigHost: authorityHost(req.Host)}
+	u.NextKnot, req.Host, err = s.UntieAuthority(req.Host)
 	if err != nil && err != knotchain.ErrNoKnotToUntie {
-		return nil, nil, err
+		return nil, err
 	}
-	req.Host = net.JoinHostPort(newHost, port)
+	u.Hostname = authorityHost(req.Host)
 
 	// Prepend the read part
 	buf := &bytes.Buffer{}
@@ -270,45 +709,112 @@ func (s *TCPServer) untieHTTPHost(r *bufio.Reader) ([]byte, knotchain.Knot, erro
 	} else {
 		req.Write(buf)
 	}
-	return buf.Bytes(), nextKnot, err
+	u.Readahead = buf.Bytes()
+	return u, err
 }
 
-func (s *TCPServer) untieClientHelloRecord(r io.Reader) ([]byte, knotchain.Knot, error) {
-	record, err := dissector.ReadRecord(r)
-	if err != nil {
-		return nil, nil, err
+// untieClientHello reassembles a ClientHello that may be fragmented
+// across several records, unties its SNI and re-emits it either in a
+// single record or in the client's original fragmentation.
+func (s *TCPServer) untieClientHello(r io.Reader) (*Untied, error) {
+	var records []*dissector.Record
+	var msg []byte
+	msgLen := -1
+	for msgLen < 0 || len(msg) < msgLen {
+		record, err := dissector.ReadRecord(r)
+		if err != nil {
+			return nil, err
+		}
+		if record.Type != dissector.Handshake {
+			return nil, fmt.Errorf("unexpected record type %d", record.Type)
+		}
+		records = append(records, record)
+		msg = append(msg, record.Opaque...)
+		if msgLen < 0 && len(msg) >= handshakeHeaderLen {
+			msgLen = handshakeHeaderLen + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+			if msgLen > maxClientHelloLen {
+				return nil, fmt.Errorf("ClientHello is too large: %d", msgLen)
+			}
+		}
 	}
 	clientHello := &dissector.ClientHelloHandshake{}
-	if err := clientHello.Decode(record.Opaque); err != nil {
-		return nil, nil, err
+	if err := clientHello.Decode(msg[:msgLen]); err != nil {
+		return nil, err
 	}
 
-	var nextKnot knotchain.Knot
+	u := &Untied{Proto: "tls"}
+	var err error
 	for _, ext := range clientHello.Extensions {
+		if ext.Type() == extALPN {
+			u.ALPN = parseALPN(ext.Bytes())
+		}
 		if ext.Type() != dissector.ExtServerName {
 			continue
 		}
 		snExtension := ext.(*dissector.ServerNameExtension)
-		nextKnot, snExtension.Name, err = knotchain.UntieHostname(snExtension.Name)
+		// The ClientHello is part of the handshake transcript, so unlike
+		// the plaintext protocols the SNI must reach the final backend as
+		// the client sent it. Untie leaves it so when the chain is exhausted.
+		u.OrigHost = snExtension.Name
+		u.NextKnot, snExtension.Name, err = knotchain.UntieHostname(snExtension.Name)
 		if err != nil && err != knotchain.ErrNoKnotToUntie {
-			return nil, nil, err
+			return nil, err
 		}
-		break
+		u.Hostname = snExtension.Name
 	}
-	record.Opaque, err = clientHello.Encode()
+	hello, err := clientHello.Encode()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	// Anything the client sent after the ClientHello in the same record
+	hello = append(hello, msg[msgLen:]...)
 
 	buf := &bytes.Buffer{}
-	if _, err := record.WriteTo(buf); err != nil {
-		return nil, nil, err
+	for i := 0; len(hello) > 0; i++ {
+		size := maxRecordLen
+		if s.conf().KeepTLSFragments && i < len(records)-1 {
+			size = len(records[i].Opaque)
+		}
+		size = min(size, len(hello))
+		record := &dissector.Record{
+			Type:    dissector.Handshake,
+			Version: records[0].Version,
+			Opaque:  hello[:size],
+		}
+		if _, err := record.WriteTo(buf); err != nil {
+			return nil, err
+		}
+		hello = hello[size:]
 	}
+	u.Readahead = buf.Bytes()
 
-	if nextKnot == nil {
+	if u.NextKnot == nil {
 		err = knotchain.ErrNoKnotToUntie
 	}
-	return buf.Bytes(), nextKnot, err
+	return u, err
+}
+
+const extALPN uint16 = 16
+
+// parseALPN returns the protocols of a raw ALPN extension
+func parseALPN(ext []byte) []string {
+	var protos []string
+	// Skip the extension header and the list length
+	if len(ext) < 6 {
+		return nil
+	}
+	for b := ext[6:]; len(b) > 0 && len(b) > int(b[0]); b = b[1+int(b[0]):] {
+		protos = append(protos, string(b[1:1+int(b[0])]))
+	}
+	return protos
+}
+
+// authorityHost strips the port off host[:port]
+func authorityHost(authority string) string {
+	if host, _, err := net.SplitHostPort(authority); err == nil {
+		return host
+	}
+	return authority
 }
 
 type wrappedConn struct {
@@ -330,34 +836,202 @@ func (c *wrappedConn) Read(b []byte) (int, error) {
 	return c.br.Read(b)
 }
 
-func transport(rw1, rw2 io.ReadWriter) error {
-	if rw1 == nil {
-		return fmt.Errorf("transport: rw1 is nil")
+// drain writes the readahead and the bytes buffered by the reader to w,
+// after which the rest of the stream can be read from the raw conn
+func (c *wrappedConn) drain(w io.Writer) (int64, error) {
+	var total int64
+	// Empty writes are skipped, they block on some conns like net.Pipe
+	if len(c.prepend) > 0 {
+		n, err := w.Write(c.prepend)
+		c.prepend = nil
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	if c.br.Buffered() > 0 {
+		buffered, _ := c.br.Peek(c.br.Buffered())
+		m, err := w.Write(buffered)
+		c.br.Discard(m)
+		total += int64(m)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// rawConn unwraps the conn the kernel can splice
+func rawConn(c net.Conn) net.Conn {
+	if p, ok := c.(*proxiedConn); ok {
+		return p.Conn
+	}
+	return c
+}
+
+var (
+	errHandshakeTimeout = errors.New("handshake timeout")
+	errDialTimeout      = errors.New("dial timeout")
+	errIdleTimeout      = errors.New("idle timeout")
+)
+
+// timeoutErr replaces a deadline error by the timeout behind it
+func timeoutErr(err, timeout error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		return timeout
+	}
+	return err
+}
+
+// relayCounter counts the bytes relayed in one direction of a connection
+// and of its listener
+type relayCounter struct {
+	n         atomic.Int64
+	metric    prometheus.Counter
+	direction string
+
+	// bandwidth limits, set up by shape
+	limits []*rateLimit
+	logger *slog.Logger
+	hit    []bool
+}
+
+func (c *relayCounter) add(n int64) {
+	c.n.Add(n)
+	c.metric.Add(float64(n))
+}
+
+// relayCounter returns a counter of upstream or downstream bytes
+func (s *TCPServer) relayCounter(direction string) *relayCounter {
+	return &relayCounter{
+		metric:    relayedBytes.WithLabelValues(s.mode.String(), direction),
+		direction: direction,
 	}
-	if rw2 == nil {
-		return fmt.Errorf("transport: rw2 is nil")
+}
+
+// chunk is the most the next copy may move, no more than any burst
+func (c *relayCounter) chunk() int64 {
+	n := int64(relayChunk)
+	for _, l := range c.limits {
+		l.mu.Lock()
+		if b := int64(l.burst); b > 0 && b < n {
+			n = b
+		}
+		l.mu.Unlock()
 	}
-	errc := make(chan error, 1)
+	return n
+}
+
+// throttle charges n bytes to the limits and waits until they are paid
+// off. The first hit of each limit is logged.
+func (c *relayCounter) throttle(n int64) {
+	var wait time.Duration
+	for i, l := range c.limits {
+		d := l.take(n)
+		if d <= 0 {
+			continue
+		}
+		wait = max(wait, d)
+		if c.hit == nil {
+			c.hit = make([]bool, len(c.limits))
+		}
+		if !c.hit[i] {
+			c.hit[i] = true
+			c.logger.Info("bandwidth limited", "limit", l.name, "direction", c.direction, "rate", int64(l.rate))
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// relayChunk is the most a relay moves between updating its counter
+const relayChunk = 1 << 20
+
+// relayTick bounds how stale the counters and the idle checks get
+const relayTick = time.Second
+
+// transport relays between the client and remote until both directions
+// are done, passing an EOF on as a half-close. The bytes read ahead by the
+// untie are sent first, so that the raw conns are left to be spliced where
+// the platform can. With a positive idle it gives up once neither
+// direction carried data for idle.
+func transport(client *wrappedConn, remote net.Conn, idle time.Duration, up, down *relayCounter) error {
+	if remote == nil {
+		return fmt.Errorf("transport: remote is nil")
+	}
+	n, err := client.drain(remote)
+	up.add(n)
+	if err != nil {
+		return err
+	}
+	raw := rawConn(client.Conn)
+
+	var upActive, downActive atomic.Int64
+	upActive.Store(time.Now().UnixNano())
+	downActive.Store(time.Now().UnixNano())
+	errc := make(chan error, 2)
 	go func() {
-		errc <- copyBuffer(rw1, rw2)
+		errc <- relay(remote, raw, idle, up, &upActive, &downActive)
 	}()
 
 	go func() {
-		errc <- copyBuffer(rw2, rw1)
+		errc <- relay(raw, remote, idle, down, &downActive, &upActive)
 	}()
 
-	if err := <-errc; err != nil && err != io.EOF {
+	// A direction ending in a half-close leaves the other one running. On
+	// an error both conns are closed to stop the other one, which still
+	// counts what it moved before the relay is over.
+	if err = <-errc; err == nil {
+		err = <-errc
+	} else {
+		raw.Close()
+		remote.Close()
+		<-errc
+	}
+	if err != nil && err != io.EOF {
 		return err
 	}
-
 	return nil
 }
 
-func copyBuffer(dst io.Writer, src io.Reader) error {
-	buf := bufferPool.Get().([]byte)
-	defer bufferPool.Put(buf)
-
+// relay copies src to dst in chunks, which *net.TCPConn splices on Linux.
+// The read deadline ends a chunk at every tick to update the counter and
+// check whether both directions have been idle.
+func relay(dst, src net.Conn, idle time.Duration, counter *relayCounter, active, peerActive *atomic.Int64) error {
+	tick := relayTick
+	if idle > 0 && idle/2 < tick {
+		tick = idle / 2
+	}
+	for {
+		src.SetReadDeadline(time.Now().Add(tick))
+		n, err := io.CopyN(dst, src, counter.chunk())
+		if n > 0 {
+			counter.add(n)
+			active.Store(time.Now().UnixNano())
+			if len(counter.limits) > 0 {
+				counter.throttle(n)
+				// Waiting for bandwidth is not idling
+				active.Store(time.Now().UnixNano())
+			}
+		}
+		switch {
+		case err == nil:
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			if idle > 0 && sinceNano(active) >= idle && sinceNano(peerActive) >= idle {
+				return errIdleTimeout
+			}
+		case err == io.EOF:
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+				return nil
+			}
+			return io.EOF
+		default:
+			return err
+		}
+	}
+}
 
-	_, err := io.CopyBuffer(dst, src, buf)
-	return err
-}
\ No newline at end of file
+func sinceNano(t *atomic.Int64) time.Duration {
+	return time.Since(time.Unix(0, t.Load()))
+}
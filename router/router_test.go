@@ -0,0 +1,102 @@
+package router
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/Max-Sum/quipu/knotchain"
+	"github.com/Max-Sum/quipu/knotchain/knot"
+	dissector "github.com/go-gost/tls-dissector"
+)
+
+// clientHello returns the handshake message a TLS client opens with
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		defer client.Close()
+		tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+	}()
+	record, err := dissector.ReadRecord(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record.Opaque
+}
+
+func TestUntieClientHelloFragments(t *testing.T) {
+	hostname, err := knotchain.TieChainToHostname(&knotchain.KnotChain{
+		Version: knotchain.Version1,
+		Knots:   []knotchain.Knot{&knot.Domain{Addr: "backend.example", IPort: 443}},
+	}, "stem.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, untied, err := knotchain.UntieHostname(hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := clientHello(t, hostname)
+	for _, sizes := range [][]int{
+		{len(hello)},
+		{1, len(hello) - 1},
+		{3, 40, len(hello) - 43},
+		{len(hello) - 1, 1},
+		{100, 2, len(hello) - 102},
+	} {
+		for _, keep := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%v keep %v", sizes, keep), func(t *testing.T) {
+				var in bytes.Buffer
+				for p, rest := 0, hello; p < len(sizes); p++ {
+					record := &dissector.Record{Type: dissector.Handshake, Version: tls.VersionTLS10, Opaque: rest[:sizes[p]]}
+					record.WriteTo(&in)
+					rest = rest[sizes[p]:]
+				}
+				cfg := GetDefaultConf()
+				cfg.KeepTLSFragments = keep
+				u, err := NewTCPServer("", ModeTLS, cfg).untieClientHello(&in)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if u.OrigHost != hostname || u.Hostname != untied || u.NextKnot == nil {
+					t.Errorf("untied %q to %q, knot %v, want %q", u.OrigHost, u.Hostname, u.NextKnot, untied)
+				}
+
+				var got []int
+				var msg []byte
+				for out := bytes.NewReader(u.Readahead); out.Len() > 0; {
+					record, err := dissector.ReadRecord(out)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, len(record.Opaque))
+					msg = append(msg, record.Opaque...)
+				}
+				want := []int{len(hello)}
+				if keep {
+					want = sizes
+				}
+				if fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("record sizes %v, want %v", got, want)
+				}
+				ch := &dissector.ClientHelloHandshake{}
+				if err := ch.Decode(msg); err != nil {
+					t.Fatal(err)
+				}
+				sni := ""
+				for _, ext := range ch.Extensions {
+					if sn, ok := ext.(*dissector.ServerNameExtension); ok {
+						sni = sn.Name
+					}
+				}
+				if sni != untied {
+					t.Errorf("re-emitted SNI %q, want %q", sni, untied)
+				}
+			})
+		}
+	}
+}
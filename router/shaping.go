@@ -0,0 +1,154 @@
+package router
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bandwidth limits are token buckets of bytes, one per direction. A relay
+// moves at most a burst at a time and sleeps off the debt it ran into,
+// which keeps the kernel splicing between the waits.
+
+// rateLimit lets rate bytes per second through, up to burst at once
+type rateLimit struct {
+	name string // conn, client or class
+	key  string // of a shared limit
+
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	refs   int
+}
+
+func (l *rateLimit) set(rate, burst int64) {
+	if burst <= 0 {
+		burst = rate
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate, l.burst = float64(rate), float64(burst)
+}
+
+// take charges n bytes and returns how long the debt takes to pay off
+func (l *rateLimit) take(n int64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = l.burst
+	} else {
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// sharedLimits holds the limits shared by the connections of a client IP
+// or a destination class while any of them is open
+type sharedLimits struct {
+	mu     sync.Mutex
+	limits map[string]*rateLimit
+}
+
+var bandwidth sharedLimits
+
+func (s *sharedLimits) acquire(name, key string, rate, burst int64) *rateLimit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.limits[key]
+	if !ok {
+		if s.limits == nil {
+			s.limits = make(map[string]*rateLimit)
+		}
+		l = &rateLimit{name: name, key: key}
+		s.limits[key] = l
+	}
+	l.refs++
+	// A reload changes the rate of open connections too
+	l.set(rate, burst)
+	return l
+}
+
+func (s *sharedLimits) release(l *rateLimit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l.refs--; l.refs <= 0 {
+		delete(s.limits, l.key)
+	}
+}
+
+// shape puts both directions of a connection under the bandwidth limits
+// of the connection, its client and the class of its destination. The
+// returned func releases the shared limits.
+func (s *TCPServer) shape(cfg *Config, logger *slog.Logger, client net.Addr, class string, up, down *relayCounter) func() {
+	var shared []*rateLimit
+	for _, c := range []*relayCounter{up, down} {
+		c.logger = logger
+		if cfg.ConnRate > 0 {
+			l := &rateLimit{name: "conn"}
+			l.set(cfg.ConnRate, cfg.ConnBurst)
+			c.limits = append(c.limits, l)
+		}
+		if ip := addrIP(client); ip != nil && cfg.ClientRate > 0 {
+			l := bandwidth.acquire("client", "client "+ip.String()+" "+c.direction, cfg.ClientRate, cfg.ClientBurst)
+			c.limits = append(c.limits, l)
+			shared = append(shared, l)
+		}
+		if rate, ok := cfg.classRates[class]; ok {
+			l := bandwidth.acquire("class", "class "+class+" "+c.direction, rate[0], rate[1])
+			c.limits = append(c.limits, l)
+			shared = append(shared, l)
+		}
+	}
+	return func() {
+		for _, l := range shared {
+			bandwidth.release(l)
+		}
+	}
+}
+
+// BuildClassRates parses ClassRates
+func (c *Config) BuildClassRates() error {
+	c.classRates = nil
+	for _, entry := range strings.Split(c.ClassRates, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		class, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid class rate: %s", entry)
+		}
+		class = strings.ToLower(strings.TrimSpace(class))
+		if class != "final" && class != "redirect" && class != "tunnel" {
+			return fmt.Errorf("unknown destination class: %s", class)
+		}
+		rateStr, burstStr, _ := strings.Cut(value, ":")
+		rate, err := strconv.ParseInt(strings.TrimSpace(rateStr), 10, 64)
+		if err != nil || rate <= 0 {
+			return fmt.Errorf("invalid class rate: %s", entry)
+		}
+		var burst int64
+		if burstStr != "" {
+			if burst, err = strconv.ParseInt(strings.TrimSpace(burstStr), 10, 64); err != nil || burst < 0 {
+				return fmt.Errorf("invalid class burst: %s", entry)
+			}
+		}
+		if c.classRates == nil {
+			c.classRates = make(map[string][2]int64)
+		}
+		c.classRates[class] = [2]int64{rate, burst}
+	}
+	return nil
+}
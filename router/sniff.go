@@ -0,0 +1,172 @@
+package router
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ginuerzh/gosocks4"
+	"github.com/ginuerzh/gosocks5"
+	dissector "github.com/go-gost/tls-dissector"
+)
+
+// Sniffer recognizes a protocol by the first bytes of a connection and
+// unties the host of its first request.
+type Sniffer interface {
+	// Match peeks at r to tell whether the connection speaks the protocol.
+	// It must not peek beyond what any client of the sniffers tried before
+	// sends ahead of waiting for the server, or it stalls them.
+	Match(r *bufio.Reader) bool
+	// Untie reads the first request off r, unties its host with
+	// UntieHostname or UntieAuthority of s, and returns it rewritten.
+	// knotchain.ErrNoKnotToUntie is returned along with a request at the
+	// end of its chain.
+	Untie(s *TCPServer, r *bufio.Reader) (*Untied, error)
+}
+
+var (
+	sniffersMu sync.RWMutex
+	sniffers   = make(map[string]Sniffer)
+)
+
+// RegisterSniffer makes a sniffer available to the sniffers option of the
+// listeners under name, replacing the one registered before. Register
+// before loading the config.
+func RegisterSniffer(name string, sn Sniffer) {
+	sniffersMu.Lock()
+	defer sniffersMu.Unlock()
+	sniffers[strings.ToLower(name)] = sn
+}
+
+func lookupSniffers(names []string) ([]Sniffer, error) {
+	sniffersMu.RLock()
+	defer sniffersMu.RUnlock()
+	list := make([]Sniffer, 0, len(names))
+	for _, name := range names {
+		sn, ok := sniffers[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown sniffer: %s", name)
+		}
+		list = append(list, sn)
+	}
+	return list, nil
+}
+
+// modeSniffers returns the sniffers of a listener mode, in order
+func modeSniffers(mode ListenMode) []Sniffer {
+	names := []string{"socks4", "socks5", "h2c", "http"}
+	switch mode {
+	case ModeTLS:
+		names = []string{"tls"}
+	case ModeMux, ModeTunnel:
+		names = append([]string{"tls"}, names...)
+	}
+	list, _ := lookupSniffers(names)
+	return list
+}
+
+var errNoSniffer = errors.New("no sniffer matched")
+
+// sniff returns the first of sniffers matching r
+func sniff(sniffers []Sniffer, r *bufio.Reader) (Sniffer, error) {
+	if _, err := r.Peek(1); err != nil {
+		return nil, err
+	}
+	for _, sn := range sniffers {
+		if sn.Match(r) {
+			return sn, nil
+		}
+	}
+	return nil, errNoSniffer
+}
+
+// BuildSniffers resolves the sniffers option, empty for those of the mode
+func (lc *ListenerConfig) BuildSniffers() (err error) {
+	lc.sniffers = nil
+	if strings.TrimSpace(lc.Sniffers) == "" {
+		return nil
+	}
+	if lc.sniffers, err = lookupSniffers(strings.Split(lc.Sniffers, ",")); err != nil {
+		return fmt.Errorf("invalid sniffers, err: %v", err)
+	}
+	return nil
+}
+
+func peekByte(r *bufio.Reader) (byte, bool) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return 0, false
+	}
+	return b[0], true
+}
+
+type socks4Sniffer struct{}
+
+func (socks4Sniffer) Match(r *bufio.Reader) bool {
+	b, ok := peekByte(r)
+	return ok && b == gosocks4.Ver4
+}
+
+func (socks4Sniffer) Untie(s *TCPServer, r *bufio.Reader) (*Untied, error) {
+	return s.untieSocks4Host(r)
+}
+
+type socks5Sniffer struct{}
+
+func (socks5Sniffer) Match(r *bufio.Reader) bool {
+	b, ok := peekByte(r)
+	return ok && b == gosocks5.Ver5
+}
+
+func (socks5Sniffer) Untie(s *TCPServer, r *bufio.Reader) (*Untied, error) {
+	return s.untieSocks5Host(r)
+}
+
+type h2cSniffer struct{}
+
+// Every HTTP/1 request line has 4 bytes ahead of the URI, and the PRI
+// method is reserved for the HTTP/2 preface
+func (h2cSniffer) Match(r *bufio.Reader) bool {
+	if b, ok := peekByte(r); !ok || b != h2cPreface[0] {
+		return false
+	}
+	b, err := r.Peek(4)
+	return err == nil && string(b) == h2cPreface[:4]
+}
+
+func (h2cSniffer) Untie(s *TCPServer, r *bufio.Reader) (*Untied, error) {
+	return s.untieH2CHost(r)
+}
+
+type httpSniffer struct{}
+
+// Methods are upper case tokens
+func (httpSniffer) Match(r *bufio.Reader) bool {
+	b, ok := peekByte(r)
+	return ok && b >= 'A' && b <= 'Z'
+}
+
+func (httpSniffer) Untie(s *TCPServer, r *bufio.Reader) (*Untied, error) {
+	return s.untieHTTPHost(r)
+}
+
+type tlsSniffer struct{}
+
+func (tlsSniffer) Match(r *bufio.Reader) bool {
+	b, ok := peekByte(r)
+	return ok && b == dissector.Handshake
+}
+
+func (tlsSniffer) Untie(s *TCPServer, r *bufio.Reader) (*Untied, error) {
+	return s.untieClientHello(r)
+}
+
+func init() {
+	RegisterSniffer("socks4", socks4Sniffer{})
+	RegisterSniffer("socks5", socks5Sniffer{})
+	RegisterSniffer("h2c", h2cSniffer{})
+	RegisterSniffer("http", httpSniffer{})
+	RegisterSniffer("tls", tlsSniffer{})
+}
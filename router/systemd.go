@@ -0,0 +1,52 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd
+const listenFDsStart = 3
+
+// ActivatedListeners returns the sockets passed by systemd socket
+// activation, by their FileDescriptorName. A socket without a name is an
+// error, as nothing would serve it. The LISTEN_* variables are cleared so
+// children do not inherit them.
+func ActivatedListeners() (map[string][]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	listeners := make(map[string][]net.Listener)
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		// systemd names sockets without a FileDescriptorName "unknown"
+		if i >= len(names) || names[i] == "" || names[i] == "unknown" {
+			return nil, fmt.Errorf("socket fd %d has no FileDescriptorName", fd)
+		}
+		name := names[i]
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %s (fd %d) is not a listener: %v", name, fd, err)
+		}
+		listeners[name] = append(listeners[name], ln)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,42 @@
+package router
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/Max-Sum/quipu/knotchain"
+)
+
+// A stem with a certificate has TLS terminated by the router once its chain
+// is exhausted. The decrypted stream is then untied like one to the plain
+// listener, so it may carry HTTP or SOCKS for a final backend or the next hop.
+
+// BuildCertificates loads the certificates of the stems
+func (c *Config) BuildCertificates() error {
+	for stem, sc := range c.Stems {
+		if sc.TLSCert == "" && sc.TLSKey == "" {
+			continue
+		}
+		if sc.TLSCert == "" || sc.TLSKey == "" {
+			return fmt.Errorf("[stem:%s] needs both tls_cert and tls_key", stem)
+		}
+		cert, err := tls.LoadX509KeyPair(sc.TLSCert, sc.TLSKey)
+		if err != nil {
+			return fmt.Errorf("[stem:%s] failed to load certificate, err: %v", stem, err)
+		}
+		sc.Certificate = &cert
+	}
+	return nil
+}
+
+// terminateConfig returns the TLS config to terminate a hostname with, nil
+// when its stem has no certificate
+func (c *Config) terminateConfig(hostname string) *tls.Config {
+	stem, _ := knotchain.StemHostname(hostname)
+	cert := c.StemConf(stem).Certificate
+	if cert == nil {
+		return nil
+	}
+	// No ALPN, clients fall back to HTTP/1.1 which the plain untie expects
+	return &tls.Config{Certificates: []tls.Certificate{*cert}}
+}
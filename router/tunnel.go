@@ -0,0 +1,328 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Max-Sum/quipu/knotchain"
+	"github.com/hashicorp/yamux"
+)
+
+// Tunnels carry redirected connections to peer routers as yamux streams.
+// Both routers prove the shared secret: the accepting one sends a nonce,
+// the dialing one answers with its HMAC and a nonce of its own, and the
+// accepting one answers that in turn. The HMACs cover both nonces and the
+// role, so neither answer can be replayed or reflected. Every stream
+// starts with a PROXY v2 header for the client, which is trusted because
+// of the secret, and is then handled like a connection to a mux listener.
+
+const (
+	tunnelMagic    = "QTUN2"
+	tunnelNonceLen = 32
+)
+
+var errNoTunnelSecret = errors.New("tunnels need tunnel_secret")
+
+// tunnelStream lets a relay half-close a stream, which is what closing a
+// yamux stream does until the peer closes too
+type tunnelStream struct {
+	*yamux.Stream
+}
+
+func (s *tunnelStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// Read reports a deadline like a net.Conn does, which the relay and the
+// handshake timeouts look for
+func (s *tunnelStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if err == yamux.ErrTimeout {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (s *tunnelStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	if err == yamux.ErrTimeout {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func tunnelConfig() *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	cfg.LogOutput = nil
+	cfg.Logger = slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn)
+	return cfg
+}
+
+func tunnelMAC(secret, role string, acceptNonce, dialNonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(tunnelMagic))
+	mac.Write([]byte(role))
+	mac.Write(acceptNonce)
+	mac.Write(dialNonce)
+	return mac.Sum(nil)
+}
+
+func tunnelNonce() ([]byte, error) {
+	nonce := make([]byte, tunnelNonceLen)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// acceptTunnel challenges a dialing peer for the secret and proves it back
+func acceptTunnel(conn net.Conn, secret string) error {
+	if secret == "" {
+		return errNoTunnelSecret
+	}
+	nonce, err := tunnelNonce()
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(append([]byte(tunnelMagic), nonce...)); err != nil {
+		return err
+	}
+	answer := make([]byte, sha256.Size+tunnelNonceLen)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return err
+	}
+	dialNonce := answer[sha256.Size:]
+	if !hmac.Equal(answer[:sha256.Size], tunnelMAC(secret, "dial", nonce, dialNonce)) {
+		return fmt.Errorf("wrong tunnel secret")
+	}
+	_, err = conn.Write(tunnelMAC(secret, "accept", nonce, dialNonce))
+	return err
+}
+
+// answerTunnel proves the secret to the accepting peer and checks that
+// the peer knows it too
+func answerTunnel(conn net.Conn, secret string) error {
+	if secret == "" {
+		return errNoTunnelSecret
+	}
+	challenge := make([]byte, len(tunnelMagic)+tunnelNonceLen)
+	if _, err := io.ReadFull(conn, challenge); err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(challenge, []byte(tunnelMagic)) {
+		return fmt.Errorf("not a quipu tunnel")
+	}
+	nonce := challenge[len(tunnelMagic):]
+	dialNonce, err := tunnelNonce()
+	if err != nil {
+		return err
+	}
+	answer := append(tunnelMAC(secret, "dial", nonce, dialNonce), dialNonce...)
+	if _, err := conn.Write(answer); err != nil {
+		return err
+	}
+	proof := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, proof); err != nil {
+		return fmt.Errorf("tunnel refused: %v", err)
+	}
+	if !hmac.Equal(proof, tunnelMAC(secret, "accept", nonce, dialNonce)) {
+		return fmt.Errorf("tunnel peer does not know the secret")
+	}
+	return nil
+}
+
+// serveTunnel authenticates a peer router and handles the streams it opens
+func (s *TCPServer) serveTunnel(conn net.Conn) {
+	defer conn.Close()
+	cfg := s.conf()
+	logger := slog.With("listener", s.mode.String(), "peer", conn.RemoteAddr().String())
+	if cfg.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(cfg.HandshakeTimeout))
+	}
+	if err := acceptTunnel(conn, cfg.TunnelSecret); err != nil {
+		logger.Info("tunnel refused", "err", timeoutErr(err, errHandshakeTimeout))
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	sess, err := yamux.Server(conn, tunnelConfig())
+	if err != nil {
+		logger.Warn("failed to start tunnel", "err", err)
+		return
+	}
+	defer sess.Close()
+	go func() {
+		// Peers stop opening streams while we drain, and the
+		// remaining streams are cut with the listener
+		select {
+		case <-s.drain:
+			sess.GoAway()
+		case <-sess.CloseChan():
+			return
+		}
+		select {
+		case <-s.ctx.Done():
+			sess.Close()
+		case <-sess.CloseChan():
+		}
+	}()
+	logger.Info("tunnel up")
+	for {
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			logger.Info("tunnel down", "err", err)
+			return
+		}
+		if !s.limiter.allowAccept(s.conf().ListenerConf(s.mode)) {
+			s.reject(logger, "unknown", "accept rate exceeded")
+			stream.Close()
+			continue
+		}
+		go s.Handle(&tunnelStream{stream})
+	}
+}
+
+// tunnelPool keeps up to size tunnels to a peer router
+type tunnelPool struct {
+	addr   string
+	secret string
+	size   int
+
+	mu       sync.Mutex
+	sessions []*yamux.Session
+	next     int
+}
+
+// Pools outlive config reloads, a changed secret or size makes a new one
+var tunnelPools sync.Map
+
+func getTunnelPool(addr, secret string, size int) *tunnelPool {
+	key := fmt.Sprintf("%s\x00%d\x00%x", addr, size, sha256.Sum256([]byte(secret)))
+	p, _ := tunnelPools.LoadOrStore(key, &tunnelPool{addr: addr, secret: secret, size: size})
+	return p.(*tunnelPool)
+}
+
+// session returns a live tunnel, dialing one while the pool is short
+func (p *tunnelPool) session(ctx context.Context) (*yamux.Session, error) {
+	p.mu.Lock()
+	live := p.sessions[:0]
+	for _, sess := range p.sessions {
+		if !sess.IsClosed() {
+			live = append(live, sess)
+		}
+	}
+	p.sessions = live
+	if len(p.sessions) >= p.size {
+		sess := p.sessions[p.next%len(p.sessions)]
+		p.next++
+		p.mu.Unlock()
+		return sess, nil
+	}
+	p.mu.Unlock()
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := answerTunnel(conn, p.secret); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	sess, err := yamux.Client(conn, tunnelConfig())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.mu.Lock()
+	p.sessions = append(p.sessions, sess)
+	p.mu.Unlock()
+	slog.Info("tunnel up", "tunnel", p.addr)
+	return sess, nil
+}
+
+// drop takes a session that refuses new streams out of the pool, leaving
+// its streams to finish
+func (p *tunnelPool) drop(sess *yamux.Session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, s := range p.sessions {
+		if s == sess {
+			p.sessions = append(p.sessions[:i], p.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// open opens a stream over a tunnel of the pool
+func (p *tunnelPool) open(ctx context.Context) (net.Conn, error) {
+	var err error
+	for attempt := 0; attempt <= p.size; attempt++ {
+		var sess *yamux.Session
+		sess, err = p.session(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var stream *yamux.Stream
+		stream, err = sess.OpenStream()
+		if err == nil {
+			return &tunnelStream{stream}, nil
+		}
+		if err == yamux.ErrRemoteGoAway {
+			p.drop(sess)
+		} else {
+			sess.Close()
+		}
+	}
+	return nil, err
+}
+
+// BuildTunnelPeers parses TunnelPeers
+func (c *Config) BuildTunnelPeers() error {
+	c.tunnelPeers = nil
+	for _, peer := range strings.Split(c.TunnelPeers, ",") {
+		peer = strings.TrimSpace(peer)
+		if peer == "" {
+			continue
+		}
+		dest, addr, ok := strings.Cut(peer, "=")
+		if !ok {
+			return fmt.Errorf("invalid tunnel peer: %s", peer)
+		}
+		host, port, err := net.SplitHostPort(strings.TrimSpace(dest))
+		if err != nil {
+			return fmt.Errorf("invalid tunnel peer: %s", peer)
+		}
+		if _, _, err := net.SplitHostPort(strings.TrimSpace(addr)); err != nil {
+			return fmt.Errorf("invalid tunnel address: %s", peer)
+		}
+		if c.tunnelPeers == nil {
+			c.tunnelPeers = make(map[string]string)
+		}
+		c.tunnelPeers[net.JoinHostPort(strings.ToLower(strings.TrimSuffix(host, ".")), port)] = strings.TrimSpace(addr)
+	}
+	if (len(c.tunnelPeers) > 0 || c.ListenTunnel != "") && c.TunnelSecret == "" {
+		return errNoTunnelSecret
+	}
+	return nil
+}
+
+// TunnelPeer returns the tunnel address of the router at a knot
+func (c *Config) TunnelPeer(k knotchain.Knot) (string, bool) {
+	host := strings.ToLower(strings.TrimSuffix(k.Host(), "."))
+	addr, ok := c.tunnelPeers[net.JoinHostPort(host, fmt.Sprint(k.Port()))]
+	return addr, ok
+}
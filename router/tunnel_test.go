@@ -0,0 +1,112 @@
+package router
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Max-Sum/quipu/knotchain"
+	"github.com/Max-Sum/quipu/knotchain/knot"
+)
+
+func TestTunnelRelayPause(t *testing.T) {
+	// The backend answers after a pause longer than a relay tick
+	be, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	go http.Serve(be, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(1500 * time.Millisecond)
+		io.WriteString(w, "late")
+	}))
+
+	peer := GetDefaultConf()
+	peer.TunnelSecret, peer.FinalHTTP = "secret", be.Addr().String()
+	peerAddr := serveTest(t, ModeTunnel, peer)
+
+	hop := &knot.IP{Addr: net.ParseIP("127.0.0.1"), IPort: 443}
+	cfg := GetDefaultConf()
+	cfg.EnableRedir, cfg.AllowPorts, cfg.ACLRules = true, "443", "allow 127.0.0.1"
+	cfg.TunnelSecret, cfg.TunnelPeers = "secret", "127.0.0.1:443="+peerAddr
+	addr := serveTest(t, ModePlain, cfg)
+
+	hostname, err := knotchain.TieChainToHostname(&knotchain.KnotChain{
+		Version: knotchain.Version1,
+		Knots:   []knotchain.Knot{hop},
+	}, "stem.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("GET / HTTP/1.1\r\nHost: " + hostname + "\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || string(body) != "late" {
+		t.Errorf("body %q, err %v, want late", body, err)
+	}
+}
+
+func TestTunnelHandshake(t *testing.T) {
+	tests := []struct {
+		name                   string
+		acceptKey, dialKey     string
+		acceptFails, dialFails bool
+	}{
+		{"same secret", "secret", "secret", false, false},
+		{"wrong dialer", "secret", "other", true, true},
+		{"wrong acceptor", "other", "secret", true, true},
+		{"no secret", "", "", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, d := net.Pipe()
+			defer a.Close()
+			defer d.Close()
+			a.SetDeadline(time.Now().Add(time.Second))
+			d.SetDeadline(time.Now().Add(time.Second))
+			accepted := make(chan error, 1)
+			go func() {
+				err := acceptTunnel(a, tt.acceptKey)
+				a.Close()
+				accepted <- err
+			}()
+			if err := answerTunnel(d, tt.dialKey); (err != nil) != tt.dialFails {
+				t.Errorf("answerTunnel: %v", err)
+			}
+			d.Close()
+			if err := <-accepted; (err != nil) != tt.acceptFails {
+				t.Errorf("acceptTunnel: %v", err)
+			}
+		})
+	}
+}
+
+func TestTunnelNeedsSecret(t *testing.T) {
+	cfg := GetDefaultConf()
+	if err := cfg.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Options{Mode: ModeTunnel, Config: cfg}); err == nil {
+		t.Error("New made a tunnel server without a secret")
+	}
+	s := NewTCPServer("", ModeTunnel, cfg)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(ln); err == nil {
+		t.Error("Serve served tunnels without a secret")
+	}
+}
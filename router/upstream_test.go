@@ -0,0 +1,60 @@
+package router
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Max-Sum/quipu/knotchain"
+	"github.com/Max-Sum/quipu/knotchain/knot"
+)
+
+func TestRedirectSendsNameToUpstream(t *testing.T) {
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	targets := make(chan string, 1)
+	go func() {
+		c, err := proxy.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+		targets <- req.Host
+		c.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+	}()
+
+	hostname, err := knotchain.TieChainToHostname(&knotchain.KnotChain{
+		Version: knotchain.Version1,
+		Knots:   []knotchain.Knot{&knot.Domain{Addr: "backend.invalid", IPort: 443}},
+	}, "stem.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := GetDefaultConf()
+	cfg.EnableRedir, cfg.AllowPorts = true, "443"
+	cfg.UpstreamProxy = "http://" + proxy.Addr().String()
+	addr := serveTest(t, ModePlain, cfg)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET / HTTP/1.1\r\nHost: " + hostname + "\r\n\r\n"))
+	select {
+	case target := <-targets:
+		if target != "backend.invalid:443" {
+			t.Errorf("CONNECT %s, want backend.invalid:443", target)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream not dialed")
+	}
+}
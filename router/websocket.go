@@ -0,0 +1,232 @@
+package router
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Max-Sum/quipu/knotchain"
+)
+
+// The WebSocket listener lets chains pass CDNs that only speak HTTP. The
+// knot chain is untied from the Host of the upgrade request, or from a
+// query parameter, and the payload of the frames is relayed as a stream.
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// untieWebSocket accepts the upgrade request of a WebSocket and unties its
+// host, refusing requests that are not an upgrade with an HTTP error
+func (s *TCPServer) untieWebSocket(conn net.Conn, r *bufio.Reader) (*Untied, *wsConn, error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := s.conf()
+	if cfg.WSPath != "" && req.URL.Path != cfg.WSPath {
+		wsRefuse(conn, http.StatusNotFound)
+		return nil, nil, fmt.Errorf("unexpected WebSocket path: %s", req.URL.Path)
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if !headerHasToken(req.Header, "Connection", "upgrade") || !headerHasToken(req.Header, "Upgrade", "websocket") ||
+		key == "" || req.Header.Get("Sec-WebSocket-Version") != "13" {
+		wsRefuse(conn, http.StatusBadRequest)
+		return nil, nil, errors.New("not a WebSocket upgrade")
+	}
+	authority := req.Host
+	if cfg.WSHostParam != "" {
+		if h := req.URL.Query().Get(cfg.WSHostParam); h != "" {
+			authority = h
+		}
+	}
+
+	u := &Untied{Proto: "ws", OrigHost: authorityHost(authority)}
+	u.NextKnot, u.Hostname, err = s.UntieAuthority(authority)
+	if err != nil && err != knotchain.ErrNoKnotToUntie {
+		wsRefuse(conn, http.StatusBadRequest)
+		return nil, nil, err
+	}
+	u.Hostname = authorityHost(u.Hostname)
+
+	accept := sha1.Sum([]byte(key + wsGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n"
+	if protos := req.Header.Get("Sec-WebSocket-Protocol"); protos != "" {
+		// Browsers fail the handshake unless one of their subprotocols is picked
+		proto, _, _ := strings.Cut(protos, ",")
+		resp += "Sec-WebSocket-Protocol: " + strings.TrimSpace(proto) + "\r\n"
+	}
+	if _, err := io.WriteString(conn, resp+"\r\n"); err != nil {
+		return nil, nil, err
+	}
+	return u, &wsConn{Conn: conn, br: r}, err
+}
+
+func wsRefuse(conn net.Conn, code int) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code))
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn reads and writes the payload of WebSocket frames. A frame header
+// is only consumed once it is complete, so reads may time out anywhere.
+// A close frame from the client reads as EOF and CloseWrite sends one back,
+// which makes a half-close of the stream.
+type wsConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	remaining  int64 // payload left in the current data frame
+	mask       [4]byte
+	maskPos    int
+	readClosed bool
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.readClosed {
+			return 0, io.EOF
+		}
+		if err := c.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.br.Read(b)
+	for i := range b[:n] {
+		b[i] ^= c.mask[(c.maskPos+i)%4]
+	}
+	c.maskPos = (c.maskPos + n) % 4
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// readHeader reads the next frame header, handling control frames whole
+func (c *wsConn) readHeader() error {
+	h, err := c.br.Peek(2)
+	if err != nil {
+		return err
+	}
+	op := h[0] & 0x0f
+	if h[1]&0x80 == 0 {
+		return errors.New("unmasked WebSocket frame")
+	}
+	length := int64(h[1] & 0x7f)
+	hdrLen := 2
+	switch length {
+	case 126:
+		hdrLen += 2
+	case 127:
+		hdrLen += 8
+	}
+	if h, err = c.br.Peek(hdrLen + 4); err != nil {
+		return err
+	}
+	switch length {
+	case 126:
+		length = int64(binary.BigEndian.Uint16(h[2:]))
+	case 127:
+		length = int64(binary.BigEndian.Uint64(h[2:]) &^ (1 << 63))
+	}
+	copy(c.mask[:], h[hdrLen:])
+	hdrLen += 4
+
+	switch op {
+	case wsContinuation, wsText, wsBinary:
+		c.br.Discard(hdrLen)
+		c.remaining, c.maskPos = length, 0
+		return nil
+	case wsClose, wsPing, wsPong:
+	default:
+		return fmt.Errorf("unknown WebSocket opcode %d", op)
+	}
+	if length > 125 {
+		return errors.New("WebSocket control frame is too large")
+	}
+	frame, err := c.br.Peek(hdrLen + int(length))
+	if err != nil {
+		return err
+	}
+	payload := make([]byte, length)
+	for i := range payload {
+		payload[i] = frame[hdrLen+i] ^ c.mask[i%4]
+	}
+	c.br.Discard(len(frame))
+	switch op {
+	case wsPing:
+		if err := c.writeFrame(wsPong, payload); err != nil && err != net.ErrClosed {
+			return err
+		}
+	case wsClose:
+		c.readClosed = true
+	}
+	return nil
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// CloseWrite sends a close frame, after which nothing more may be written
+func (c *wsConn) CloseWrite() error {
+	return c.writeFrame(wsClose, []byte{0x03, 0xe8}) // 1000, normal closure
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	hdr := make([]byte, 2, 10)
+	hdr[0] = 0x80 | op
+	switch {
+	case len(payload) < 126:
+		hdr[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(payload)))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(len(payload)))
+	}
+	bufs := net.Buffers{hdr, payload}
+	_, err := bufs.WriteTo(c.Conn)
+	if op == wsClose {
+		c.closeSent = true
+	}
+	return err
+}
@@ -0,0 +1,114 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// wsFrame is a frame as a client sends it, masked
+func wsFrame(fin bool, op byte, payload string) []byte {
+	b := []byte{op, 0x80}
+	if fin {
+		b[0] |= 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		b[1] |= byte(len(payload))
+	default:
+		b[1] |= 126
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	b = append(b, mask...)
+	for i := range payload {
+		b = append(b, payload[i]^mask[i%4])
+	}
+	return b
+}
+
+func TestWSConnRead(t *testing.T) {
+	long := string(bytes.Repeat([]byte("0123456789"), 30))
+	closeFrame := wsFrame(true, wsClose, "\x03\xe8")
+	tests := []struct {
+		name   string
+		frames [][]byte
+		split  bool // one byte per write, splitting every header
+		want   string
+		pongs  string
+	}{
+		{
+			name: "fragmented",
+			frames: [][]byte{
+				wsFrame(false, wsText, "hello "), wsFrame(false, wsContinuation, "wor"),
+				wsFrame(true, wsContinuation, "ld"), closeFrame,
+			},
+			want: "hello world",
+		},
+		{
+			name: "ping between data frames",
+			frames: [][]byte{
+				wsFrame(false, wsBinary, "ab"), wsFrame(true, wsPing, "p1"),
+				wsFrame(true, wsContinuation, "cd"), wsFrame(true, wsPing, ""), closeFrame,
+			},
+			want:  "abcd",
+			pongs: "\x8a\x02p1\x8a\x00",
+		},
+		{
+			name:   "close",
+			frames: [][]byte{wsFrame(true, wsBinary, "x"), closeFrame, wsFrame(true, wsBinary, "after close")},
+			want:   "x",
+		},
+		{
+			name: "split headers",
+			frames: [][]byte{
+				wsFrame(true, wsBinary, long), wsFrame(true, wsPing, "p"),
+				wsFrame(true, wsBinary, "end"), closeFrame,
+			},
+			split: true,
+			want:  long + "end",
+			pongs: "\x8a\x01p",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			ws := &wsConn{Conn: server, br: bufio.NewReader(server)}
+			go func() {
+				for _, f := range tt.frames {
+					if !tt.split {
+						client.Write(f)
+						continue
+					}
+					for i := range f {
+						client.Write(f[i : i+1])
+					}
+				}
+			}()
+			pongs := make(chan []byte, 1)
+			go func() {
+				b, _ := io.ReadAll(client)
+				pongs <- b
+			}()
+
+			got, err := io.ReadAll(ws)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("read %q, want %q", got, tt.want)
+			}
+			if n, err := ws.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+				t.Errorf("read after close = %d, %v, want EOF", n, err)
+			}
+			server.Close()
+			if b := <-pongs; string(b) != tt.pongs {
+				t.Errorf("answered %q, want pongs %q", b, tt.pongs)
+			}
+		})
+	}
+}